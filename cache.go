@@ -0,0 +1,418 @@
+package zipper
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+)
+
+const (
+	defaultCacheMaxDirectoryBytes = 64 << 20
+	defaultCacheTTL               = time.Minute
+)
+
+// EvictReason tells why a pack was removed from a PackCache.
+type EvictReason int
+
+const (
+	// EvictSize means the pack was the least recently used when the cache
+	// went over PackCacheOptions.MaxDirectoryBytes.
+	EvictSize EvictReason = iota
+	// EvictChanged means revalidation found the object replaced or gone.
+	EvictChanged
+	// EvictInvalidated means PackCache.Invalidate was called.
+	EvictInvalidated
+	// EvictClosed means the cache was closed.
+	EvictClosed
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictSize:
+		return "size"
+	case EvictChanged:
+		return "changed"
+	case EvictInvalidated:
+		return "invalidated"
+	case EvictClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// PackCacheOptions configures NewPackCache.
+type PackCacheOptions struct {
+	// MaxDirectoryBytes bounds the total size of the central directories
+	// of the cached packs, which is roughly the memory they hold. The least
+	// recently used packs are evicted to stay under it. A pack larger than
+	// the bound on its own is returned but not kept. Zero uses 64 MiB.
+	MaxDirectoryBytes int64
+
+	// TTL is how long a cached pack is used before it is revalidated with
+	// a StatObject call comparing its creation time and size. Zero uses a
+	// minute, and a negative TTL revalidates on every Get.
+	TTL time.Duration
+
+	// Open configures how packs are opened. Size, DirectoryOffset and
+	// DirectoryOffsetKnown are ignored, as packs are always stat'ed.
+	Open *OpenOptions
+
+	// OnEvict, if set, is called whenever a pack is removed from the cache.
+	// It is called without the cache's lock held. The pack is closed once
+	// the last Get that returned it is released, which may be later.
+	OnEvict func(bucket, key string, reason EvictReason)
+}
+
+// PackCache shares opened packs between callers, so that a pack is only
+// stat'ed and its central directory only downloaded once per TTL rather
+// than on every open. Concurrent Gets of a pack that is not cached yet
+// wait for a single open. It is safe for concurrent use.
+type PackCache struct {
+	maxBytes int64
+	ttl      time.Duration
+	opts     OpenOptions
+	onEvict  func(bucket, key string, reason EvictReason)
+
+	// stat and open are the calls to the project, replaced in tests.
+	stat func(ctx context.Context, bucket, key string) (*uplink.Object, error)
+	open func(ctx context.Context, bucket, key string, info *uplink.Object) (*Pack, error)
+	now  func() time.Time
+
+	mu      sync.Mutex
+	closed  bool
+	entries map[cacheKey]*cacheEntry
+	lru     *list.List // of cached *cacheEntry, most recently used first
+	bytes   int64
+}
+
+type cacheKey struct {
+	bucket, key string
+}
+
+type cacheEntry struct {
+	key cacheKey
+
+	// ready is closed once the pack is opened, or err is set.
+	ready chan struct{}
+	pack  *Pack
+	err   error
+	bytes int64
+
+	// checked is when the pack was last validated, and checking is set
+	// while it is being revalidated.
+	checked  time.Time
+	checking chan struct{}
+
+	// refs counts the Gets not yet released, plus one while cached.
+	refs int
+	elem *list.Element
+}
+
+// cacheEviction is a removal from the cache to report once the cache's
+// lock is released.
+type cacheEviction struct {
+	entry  *cacheEntry
+	reason EvictReason
+	close  bool
+}
+
+// NewPackCache returns a cache of the packs in proj.
+func NewPackCache(proj *uplink.Project, opts *PackCacheOptions) *PackCache {
+	if opts == nil {
+		opts = &PackCacheOptions{}
+	}
+	c := &PackCache{
+		maxBytes: opts.MaxDirectoryBytes,
+		ttl:      opts.TTL,
+		onEvict:  opts.OnEvict,
+		now:      time.Now,
+		entries:  make(map[cacheKey]*cacheEntry),
+		lru:      list.New(),
+	}
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultCacheMaxDirectoryBytes
+	}
+	if c.ttl == 0 {
+		c.ttl = defaultCacheTTL
+	}
+	if opts.Open != nil {
+		c.opts = *opts.Open
+	}
+	c.opts.Size, c.opts.DirectoryOffset, c.opts.DirectoryOffsetKnown = 0, 0, false
+
+	c.stat = func(ctx context.Context, bucket, key string) (*uplink.Object, error) {
+		return proj.StatObject(ctx, bucket, key)
+	}
+	c.open = func(ctx context.Context, bucket, key string, info *uplink.Object) (*Pack, error) {
+		opts := c.opts
+		if info == nil {
+			return OpenPackWithOptions(ctx, proj, bucket, key, &opts)
+		}
+		dirOffset := parseMetadata(info.Custom).dirOffset
+		return openObject(ctx, proj, bucket, key, info, info.System.ContentLength, dirOffset, &opts)
+	}
+	return c
+}
+
+// Get returns the pack at bucket/key, opening it if it is not cached and
+// revalidating it if its TTL has passed. release must be called once the
+// pack is no longer used, and the pack must not be closed or refreshed by
+// the caller. If reading from the pack fails with ErrPackChanged, call
+// Invalidate so that the next Get opens it again.
+//
+// When Gets are coalesced, the open uses the context of the first. If the
+// open fails because that context ended, the others open the pack again
+// with their own contexts; other errors are returned to all of them.
+func (c *PackCache) Get(ctx context.Context, bucket, key string) (_ *Pack, release func(), err error) {
+	k := cacheKey{bucket: bucket, key: key}
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, nil, errs.Errorf("pack cache is closed")
+		}
+		e := c.entries[k]
+		if e == nil {
+			e = c.add(k)
+			c.mu.Unlock()
+			return c.load(ctx, e, nil)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if e.err != nil {
+			if canceled(e.err) && ctx.Err() == nil {
+				// The failed open is no longer cached.
+				continue
+			}
+			return nil, nil, e.err
+		}
+
+		c.mu.Lock()
+		if c.entries[k] != e {
+			// Evicted while we waited.
+			c.mu.Unlock()
+			continue
+		}
+		if c.now().Sub(e.checked) < c.ttl {
+			c.lru.MoveToFront(e.elem)
+			release := c.acquire(e)
+			c.mu.Unlock()
+			return e.pack, release, nil
+		}
+		if e.checking != nil {
+			checking := e.checking
+			c.mu.Unlock()
+			select {
+			case <-checking:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			continue
+		}
+		e.checking = make(chan struct{})
+		c.mu.Unlock()
+		return c.revalidate(ctx, e)
+	}
+}
+
+// canceled reports whether err is the error of an ended context.
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Invalidate removes the pack at bucket/key from the cache, so that the
+// next Get opens it again. An open in progress is not cached.
+func (c *PackCache) Invalidate(bucket, key string) {
+	c.mu.Lock()
+	var evicted []cacheEviction
+	if e := c.entries[cacheKey{bucket: bucket, key: key}]; e != nil {
+		evicted = c.remove(evicted, e, EvictInvalidated)
+	}
+	c.mu.Unlock()
+	_ = c.evicted(evicted)
+}
+
+// Len returns the number of cached packs.
+func (c *PackCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// DirectoryBytes returns the total size of the central directories of the
+// cached packs.
+func (c *PackCache) DirectoryBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// Close evicts every pack and makes later Gets fail. Packs still in use
+// are closed once released.
+func (c *PackCache) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	var evicted []cacheEviction
+	for _, e := range c.entries {
+		evicted = c.remove(evicted, e, EvictClosed)
+	}
+	c.mu.Unlock()
+	return c.evicted(evicted)
+}
+
+// add records that the pack for k is being opened. c.mu must be held.
+func (c *PackCache) add(k cacheKey) *cacheEntry {
+	e := &cacheEntry{key: k, ready: make(chan struct{})}
+	c.entries[k] = e
+	return e
+}
+
+// load opens the pack of e, from info if it was already stat'ed, and
+// caches it.
+func (c *PackCache) load(ctx context.Context, e *cacheEntry, info *uplink.Object) (*Pack, func(), error) {
+	p, err := c.open(ctx, e.key.bucket, e.key.key, info)
+
+	c.mu.Lock()
+	if err != nil {
+		e.err = err
+		if c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+		close(e.ready)
+		c.mu.Unlock()
+		return nil, nil, err
+	}
+
+	e.pack = p
+	_, e.bytes = p.zr.Directory()
+	e.checked = c.now()
+	release := c.acquire(e)
+	var evicted []cacheEviction
+	if c.entries[e.key] == e {
+		e.refs++
+		e.elem = c.lru.PushFront(e)
+		c.bytes += e.bytes
+		for c.bytes > c.maxBytes {
+			evicted = c.remove(evicted, c.lru.Back().Value.(*cacheEntry), EvictSize)
+		}
+	}
+	close(e.ready)
+	c.mu.Unlock()
+
+	_ = c.evicted(evicted)
+	return p, release, nil
+}
+
+// revalidate checks that the pack of e is still the current version of
+// its object, replacing it if not.
+func (c *PackCache) revalidate(ctx context.Context, e *cacheEntry) (*Pack, func(), error) {
+	info, err := c.stat(ctx, e.key.bucket, e.key.key)
+	unchanged := err == nil && e.pack.info != nil &&
+		info.System.Created.Equal(e.pack.info.System.Created) &&
+		info.System.ContentLength == e.pack.info.System.ContentLength
+
+	c.mu.Lock()
+	checking := e.checking
+	e.checking = nil
+	defer close(checking)
+
+	if err != nil && !errors.Is(err, uplink.ErrObjectNotFound) {
+		// Leave the pack cached for the next Get to revalidate.
+		c.mu.Unlock()
+		return nil, nil, err
+	}
+
+	cached := c.entries[e.key] == e
+	if unchanged && cached {
+		e.checked = c.now()
+		c.lru.MoveToFront(e.elem)
+		release := c.acquire(e)
+		c.mu.Unlock()
+		return e.pack, release, nil
+	}
+
+	var evicted []cacheEviction
+	if cached {
+		evicted = c.remove(evicted, e, EvictChanged)
+	}
+	var next *cacheEntry
+	switch {
+	case err != nil:
+	case c.closed:
+		err = errs.Errorf("pack cache is closed")
+	case c.entries[e.key] == nil:
+		next = c.add(e.key)
+	}
+	c.mu.Unlock()
+
+	// Failing to close the old version is not the caller's problem.
+	_ = c.evicted(evicted)
+	if err != nil {
+		return nil, nil, err
+	}
+	if next == nil {
+		// Another Get is already opening the new version.
+		return c.Get(ctx, e.key.bucket, e.key.key)
+	}
+	return c.load(ctx, next, info)
+}
+
+// acquire takes a reference to the pack of e, and returns the function
+// releasing it. c.mu must be held.
+func (c *PackCache) acquire(e *cacheEntry) func() {
+	e.refs++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			e.refs--
+			last := e.refs == 0
+			c.mu.Unlock()
+			if last {
+				_ = e.pack.Close()
+			}
+		})
+	}
+}
+
+// remove removes e from the cache, appending the eviction to report to
+// evicted. c.mu must be held.
+func (c *PackCache) remove(evicted []cacheEviction, e *cacheEntry, reason EvictReason) []cacheEviction {
+	delete(c.entries, e.key)
+	if e.elem == nil {
+		// Still being opened, so it will not be cached.
+		return evicted
+	}
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.bytes -= e.bytes
+	e.refs--
+	return append(evicted, cacheEviction{entry: e, reason: reason, close: e.refs == 0})
+}
+
+// evicted reports the evictions, and closes the packs no longer used.
+// c.mu must not be held.
+func (c *PackCache) evicted(evicted []cacheEviction) error {
+	var group errs.Group
+	for _, ev := range evicted {
+		if c.onEvict != nil {
+			c.onEvict(ev.entry.key.bucket, ev.entry.key.key, ev.reason)
+		}
+		if ev.close {
+			group.Add(ev.entry.pack.Close())
+		}
+	}
+	return group.Err()
+}
@@ -0,0 +1,287 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// closingSource records whether the pack using it was closed.
+type closingSource struct {
+	zipread.Source
+	closed bool
+}
+
+func (s *closingSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+// fakeObjects serves in-memory packs to a PackCache.
+type fakeObjects struct {
+	mu      sync.Mutex
+	data    []byte
+	created map[string]time.Time
+	opens   map[string]int
+	sources []*closingSource
+	gate    chan struct{} // if set, opens wait for it to be closed
+}
+
+func newFakeObjects(t *testing.T, entries int) *fakeObjects {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		if _, err := p.Add(ctx, fmt.Sprintf("entry-%d.txt", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeObjects{
+		data:    u.Bytes(),
+		created: make(map[string]time.Time),
+		opens:   make(map[string]int),
+	}
+}
+
+func (f *fakeObjects) object(key string) *uplink.Object {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created, ok := f.created[key]
+	if !ok {
+		created = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		f.created[key] = created
+	}
+	return &uplink.Object{Key: key, System: uplink.SystemMetadata{
+		Created:       created,
+		ContentLength: int64(len(f.data)),
+	}}
+}
+
+func (f *fakeObjects) replace(key string) {
+	info := f.object(key)
+	f.mu.Lock()
+	f.created[key] = info.System.Created.Add(time.Hour)
+	f.mu.Unlock()
+}
+
+func (f *fakeObjects) cache(opts *PackCacheOptions) *PackCache {
+	c := NewPackCache(nil, opts)
+	c.stat = func(ctx context.Context, bucket, key string) (*uplink.Object, error) {
+		return f.object(key), nil
+	}
+	c.open = func(ctx context.Context, bucket, key string, info *uplink.Object) (*Pack, error) {
+		if f.gate != nil {
+			select {
+			case <-f.gate:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if info == nil {
+			info = f.object(key)
+		}
+		source := zipread.SourceFromReaderAt(bytes.NewReader(f.data), int64(len(f.data)))
+		p, err := openSource(ctx, source, int64(len(f.data)), 0, &OpenOptions{})
+		if err != nil {
+			return nil, err
+		}
+		p.info = info
+		closing := &closingSource{Source: p.source}
+		p.source = closing
+		f.mu.Lock()
+		f.opens[key]++
+		f.sources = append(f.sources, closing)
+		f.mu.Unlock()
+		return p, nil
+	}
+	return c
+}
+
+func TestPackCacheCoalesces(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeObjects(t, 10)
+	f.gate = make(chan struct{})
+	c := f.cache(nil)
+
+	var wg sync.WaitGroup
+	packs := make([]*Pack, 8)
+	for i := range packs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, release, err := c.Get(ctx, "bucket", "pack.zip")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			packs[i] = p
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(f.gate)
+	wg.Wait()
+
+	if f.opens["pack.zip"] != 1 {
+		t.Errorf("opened %d times, want 1", f.opens["pack.zip"])
+	}
+	for _, p := range packs {
+		if p != packs[0] {
+			t.Fatal("Gets returned different packs")
+		}
+	}
+	if f.sources[0].closed {
+		t.Error("cached pack was closed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.sources[0].closed {
+		t.Error("pack was not closed with the cache")
+	}
+}
+
+func TestPackCacheCanceledOpen(t *testing.T) {
+	f := newFakeObjects(t, 10)
+	f.gate = make(chan struct{})
+	c := f.cache(nil)
+	defer func() { _ = c.Close() }()
+
+	// The first Get opens the pack, and is canceled while the second one
+	// waits for it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := c.Get(ctx, "bucket", "pack.zip")
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		_, release, err := c.Get(context.Background(), "bucket", "pack.zip")
+		if err == nil {
+			release()
+		}
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first Get: got %v, want context.Canceled", err)
+	}
+
+	// The second Get opens the pack again with its own context.
+	close(f.gate)
+	if err := <-second; err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+	if f.opens["pack.zip"] != 1 || c.Len() != 1 {
+		t.Fatalf("got %d opens and %d cached packs, want 1 and 1", f.opens["pack.zip"], c.Len())
+	}
+}
+
+func TestPackCacheRevalidates(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeObjects(t, 10)
+	var evicted []EvictReason
+	c := f.cache(&PackCacheOptions{
+		TTL:     time.Minute,
+		OnEvict: func(bucket, key string, reason EvictReason) { evicted = append(evicted, reason) },
+	})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	first, release, err := c.Get(ctx, "bucket", "pack.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged, so revalidation keeps the pack.
+	now = now.Add(2 * time.Minute)
+	p, release2, err := c.Get(ctx, "bucket", "pack.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	if p != first || f.opens["pack.zip"] != 1 {
+		t.Fatalf("unchanged pack was reopened")
+	}
+
+	// Replaced, so the pack is evicted and opened again, but only closed
+	// once released.
+	f.replace("pack.zip")
+	now = now.Add(2 * time.Minute)
+	p, release2, err = c.Get(ctx, "bucket", "pack.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release2()
+	if p == first || f.opens["pack.zip"] != 2 {
+		t.Fatalf("replaced pack was not reopened")
+	}
+	if len(evicted) != 1 || evicted[0] != EvictChanged {
+		t.Fatalf("got evictions %v, want [changed]", evicted)
+	}
+	if f.sources[0].closed {
+		t.Fatal("evicted pack was closed while in use")
+	}
+	release()
+	release()
+	if !f.sources[0].closed {
+		t.Fatal("evicted pack was not closed once released")
+	}
+}
+
+func TestPackCacheEvictsBySize(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeObjects(t, 10)
+	var evicted []string
+	c := f.cache(&PackCacheOptions{
+		OnEvict: func(bucket, key string, reason EvictReason) {
+			evicted = append(evicted, fmt.Sprintf("%s:%v", key, reason))
+		},
+	})
+
+	get := func(key string) {
+		_, release, err := c.Get(ctx, "bucket", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	get("a")
+	c.maxBytes = 2 * c.DirectoryBytes()
+	get("b")
+	get("a")
+	get("c")
+
+	if c.Len() != 2 || len(evicted) != 1 || evicted[0] != "b:size" {
+		t.Fatalf("got %d packs and evictions %v, want 2 and [b:size]", c.Len(), evicted)
+	}
+	get("a")
+	if f.opens["a"] != 1 || f.opens["b"] != 1 {
+		t.Fatalf("got opens %v", f.opens)
+	}
+	if !f.sources[1].closed || f.sources[0].closed {
+		t.Fatal("wrong pack closed")
+	}
+
+	c.Invalidate("bucket", "a")
+	get("a")
+	if f.opens["a"] != 2 {
+		t.Fatalf("invalidated pack was not reopened")
+	}
+}
@@ -78,6 +78,7 @@ func Open(ctx context.Context, proj *uplink.Project) error {
 	if err != nil {
 		return err
 	}
+	defer p.Close()
 	log.Println("listing")
 	for _, fname := range p.List() {
 		rc, err := p.Open(ctx, fname)
@@ -0,0 +1,156 @@
+package zipper
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"storj.io/zipper/zipread"
+)
+
+const (
+	defaultAutoSampleSize = 64 * 1024
+	defaultAutoMinSavings = 0.1
+)
+
+// Compression selects how an entry's content is stored.
+type Compression int
+
+const (
+	// CompressionDefault deflates the entry unless FileHeader.Uncompressed
+	// is set.
+	CompressionDefault Compression = iota
+
+	// CompressionStore stores the entry uncompressed.
+	CompressionStore
+
+	// CompressionDeflate deflates the entry.
+	CompressionDeflate
+
+	// CompressionAuto deflates the entry only if it is worth it. Entries
+	// whose name or sniffed content type indicate already compressed data
+	// are stored, and for everything else the first bytes are compressed
+	// as a trial. See CreateOptions.AutoSampleSize and AutoMinSavings.
+	CompressionAuto
+
+	// compressionMethod is used for entries with FileHeader.Method set.
+	compressionMethod Compression = -1
+)
+
+func (h *FileHeader) compression() Compression {
+	if h.Method != 0 {
+		return compressionMethod
+	}
+	if h.Compression == CompressionDefault {
+		if h.Uncompressed {
+			return CompressionStore
+		}
+		return CompressionDeflate
+	}
+	return h.Compression
+}
+
+// compressedExts are extensions of formats that are already compressed.
+var compressedExts = map[string]bool{
+	".7z": true, ".aac": true, ".apk": true, ".avi": true, ".avif": true,
+	".br": true, ".bz2": true, ".docx": true, ".flac": true, ".gif": true,
+	".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true,
+	".lz4": true, ".m4a": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp3": true, ".mp4": true, ".ogg": true, ".opus": true, ".png": true,
+	".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true,
+	".woff": true, ".woff2": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+// compressedTypes are sniffed content types of already compressed data.
+var compressedTypes = map[string]bool{
+	"application/x-gzip":           true,
+	"application/x-rar-compressed": true,
+	"application/zip":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+	"image/gif":                    true,
+	"image/jpeg":                   true,
+	"image/png":                    true,
+	"image/webp":                   true,
+}
+
+// chooseMethod decides how an entry using CompressionAuto is stored,
+// based on its name and the start of its content.
+func (p *PendingPack) chooseMethod(name string, sample []byte) uint16 {
+	if len(sample) == 0 || compressedExts[strings.ToLower(path.Ext(name))] {
+		return zipread.Store
+	}
+	contentType := http.DetectContentType(sample)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	if compressedTypes[contentType] ||
+		strings.HasPrefix(contentType, "video/") ||
+		(strings.HasPrefix(contentType, "audio/") && contentType != "audio/wave") {
+		return zipread.Store
+	}
+
+	// Compress the sample the way the entry would be written.
+	counter := &countingWriter{w: io.Discard}
+	fw, err := p.z.Compressor(zipread.Deflate)(counter)
+	if err != nil {
+		return zipread.Deflate
+	}
+	if _, err := fw.Write(sample); err != nil {
+		return zipread.Deflate
+	}
+	if err := fw.Close(); err != nil {
+		return zipread.Deflate
+	}
+	if float64(counter.N) > float64(len(sample))*(1-p.autoMinSavings) {
+		return zipread.Store
+	}
+	return zipread.Deflate
+}
+
+// autoWriter buffers the start of an entry using CompressionAuto until
+// there is enough to decide how to store it.
+type autoWriter struct {
+	fw     *FileWriter
+	sample []byte
+	w      io.Writer // set once decided
+}
+
+func (aw *autoWriter) Write(p []byte) (int, error) {
+	if aw.w != nil {
+		return aw.w.Write(p)
+	}
+	size := aw.fw.pack.autoSampleSize
+	if len(aw.sample)+len(p) < size {
+		aw.sample = append(aw.sample, p...)
+		return len(p), nil
+	}
+	n := size - len(aw.sample)
+	aw.sample = append(aw.sample, p[:n]...)
+	if err := aw.decide(); err != nil {
+		return 0, err
+	}
+	m, err := aw.w.Write(p[n:])
+	return n + m, err
+}
+
+// decide picks the method, writes the entry header and flushes the
+// buffered sample. It does nothing if the method was already decided.
+func (aw *autoWriter) decide() error {
+	if aw.w != nil {
+		return nil
+	}
+	p := aw.fw.pack
+	aw.fw.header.Method = p.chooseMethod(aw.fw.header.Name, aw.sample)
+	w, err := p.createEntry(aw.fw)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(aw.sample); err != nil {
+		return err
+	}
+	aw.w, aw.sample = w, nil
+	return nil
+}
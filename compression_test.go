@@ -0,0 +1,124 @@
+package zipper
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"storj.io/zipper/zipread"
+)
+
+// noisyBytes returns n bytes drawn from alphabet distinct values, which
+// deflate compresses to roughly log2(alphabet)/8 of their size.
+func noisyBytes(seed int64, n, alphabet int) []byte {
+	rng := rand.New(rand.NewSource(seed))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rng.Intn(alphabet))
+	}
+	return data
+}
+
+func TestCompressionAuto(t *testing.T) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 5000)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), noisyBytes(1, 1000, 256)...)
+	random := noisyBytes(2, 200000, 256)
+
+	for _, test := range []struct {
+		name    string
+		content []byte
+		opts    CreateOptions
+		want    uint16
+	}{
+		{"text.txt", []byte(text), CreateOptions{}, zipread.Deflate},
+		{"short.txt", []byte(text[:1000]), CreateOptions{}, zipread.Deflate},
+		{"empty.txt", nil, CreateOptions{}, zipread.Store},
+		{"photo.JPG", []byte(text), CreateOptions{}, zipread.Store},
+		{"image", png, CreateOptions{}, zipread.Store},
+		{"random.bin", random, CreateOptions{}, zipread.Store},
+		{"short-random.bin", random[:1000], CreateOptions{}, zipread.Store},
+
+		// Only the sample is looked at.
+		{"sampled.bin", append(append([]byte{}, random[:1024]...), text...), CreateOptions{AutoSampleSize: 1024}, zipread.Store},
+		{"sampled.txt", append([]byte(text[:1024]), random...), CreateOptions{AutoSampleSize: 1024}, zipread.Deflate},
+
+		// Four bit noise deflates to a bit over half its size.
+		{"half.bin", noisyBytes(3, 100000, 16), CreateOptions{AutoMinSavings: 0.3}, zipread.Deflate},
+		{"half.bin", noisyBytes(3, 100000, 16), CreateOptions{AutoMinSavings: 0.6}, zipread.Store},
+
+		// The sample is compressed at the level entries are written with.
+		{"huffman.txt", []byte(text), CreateOptions{CompressionLevel: flate.HuffmanOnly, AutoMinSavings: 0.6}, zipread.Store},
+	} {
+		for _, concurrency := range []int{0, 4} {
+			ctx := context.Background()
+			opts := test.opts
+			opts.Concurrency = concurrency
+			u := new(MemoryDestination)
+			p, err := CreatePackTo(ctx, u, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := p.Add(ctx, test.name, &FileHeader{Compression: CompressionAuto})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Write in pieces so the sample is assembled across writes.
+			for r := bytes.NewReader(test.content); r.Len() > 0; {
+				if _, err := io.CopyN(w, r, 777); err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			pack := openMemoryPack(t, u, nil)
+			fi, err := pack.FileInfo(ctx, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Method != test.want {
+				t.Errorf("%s, %+v: got method %d, want %d", test.name, opts, fi.Method, test.want)
+			}
+			if got := readEntry(t, pack, test.name); got != string(test.content) {
+				t.Errorf("%s, %+v: wrong content", test.name, opts)
+			}
+		}
+	}
+}
+
+func TestCompressionAutoCompressor(t *testing.T) {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflate, err := zipread.DeflateCompressor(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	p.RegisterCompressor(zipread.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		calls++
+		return deflate(w)
+	})
+	w, err := p.Add(ctx, "text.txt", &FileHeader{Compression: CompressionAuto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, strings.Repeat("some text ", 10000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Once for the sample and once for the entry.
+	if calls != 2 {
+		t.Errorf("registered compressor used %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,74 @@
+package zipper
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// dedup tracks the contents of the entries of a pack created with
+// CreateOptions.Dedup.
+type dedup struct {
+	// queued holds the contents of the entries submitted so far, and
+	// written the index in the archive of the first entry with them.
+	// sums maps those indexes back to the contents, for the journal.
+	queued  map[[sha256.Size]byte]bool
+	written map[[sha256.Size]byte]int
+	sums    map[int][sha256.Size]byte
+}
+
+func newDedup() *dedup {
+	return &dedup{
+		queued:  make(map[[sha256.Size]byte]bool),
+		written: make(map[[sha256.Size]byte]int),
+		sums:    make(map[int][sha256.Size]byte),
+	}
+}
+
+// wrote records that the i'th entry of the archive holds the content
+// hashed to sum.
+func (d *dedup) wrote(sum [sha256.Size]byte, i int) {
+	d.queued[sum] = true
+	d.written[sum] = i
+	d.sums[i] = sum
+}
+
+// digest returns the content hash recorded for the i'th entry, if any.
+func (d *dedup) digest(i int) []byte {
+	if d == nil {
+		return nil
+	}
+	sum, ok := d.sums[i]
+	if !ok {
+		return nil
+	}
+	return sum[:]
+}
+
+// check records the content of job, as hashed by digest, and marks job as
+// a duplicate if an earlier entry has the same content.
+func (d *dedup) check(job *entryJob, digest hash.Hash) {
+	copy(job.sum[:], digest.Sum(nil))
+	if d.queued[job.sum] {
+		job.dup = true
+		return
+	}
+	d.queued[job.sum] = true
+}
+
+// emitDuplicate writes a central directory record for job that points at
+// the contents of the earlier entry it duplicates.
+func (p *PendingPack) emitDuplicate(job *entryJob) error {
+	i, ok := p.dedup.written[job.sum]
+	if !ok {
+		return errs.Errorf("%q: duplicated entry was not written", job.header.Name)
+	}
+	if err := p.z.AppendDuplicate(job.header, i); err != nil {
+		return err
+	}
+	job.fw.contentOffset = p.z.ContentOffset(i)
+	job.fw.addDigest()
+	job.fw.done = true
+	return nil
+}
@@ -0,0 +1,270 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// Destination is where a PendingPack writes its archive. The archive is
+// written with Write, then the custom metadata, including the directory
+// offset, is set and the destination is committed. Commit and Abort are
+// given the context of the PendingPack call making them.
+type Destination interface {
+	io.Writer
+	SetCustomMetadata(ctx context.Context, custom uplink.CustomMetadata) error
+	Commit(ctx context.Context) error
+	Abort(ctx context.Context) error
+}
+
+// commentMetadata is implemented by destinations that can keep the custom
+// metadata in the archive comment, which has to be known before the
+// central directory is written.
+type commentMetadata interface {
+	metadataInComment() bool
+	metadataComment(custom uplink.CustomMetadata) (string, error)
+}
+
+// checkCommentMetadata returns an error if custom, along with the pack
+// metadata added to it on commit, would not fit in the archive comment.
+func checkCommentMetadata(cm commentMetadata, custom uplink.CustomMetadata) error {
+	sample := make(uplink.CustomMetadata, len(custom)+8)
+	for key, value := range custom {
+		sample[key] = value
+	}
+	largest := packMetadata{
+		dirOffset:        math.MaxInt64,
+		dirSize:          math.MaxInt64,
+		entries:          math.MaxInt64,
+		uncompressedSize: math.MaxInt64,
+	}
+	largest.set(sample)
+	if _, set := sample[contentTypeKey]; !set {
+		sample[contentTypeKey] = contentTypeZip
+	}
+	comment, err := cm.metadataComment(sample)
+	if err != nil {
+		return err
+	}
+	if len(comment) > maxCommentLen {
+		return errs.Errorf("custom metadata too large to keep in the archive comment")
+	}
+	return nil
+}
+
+// NewUplinkDestination starts uploading an object to write a pack to.
+func NewUplinkDestination(ctx context.Context, proj *uplink.Project, bucket, key string,
+	options *uplink.UploadOptions) (Destination, error) {
+	u, err := proj.UploadObject(ctx, bucket, key, options)
+	if err != nil {
+		return nil, err
+	}
+	return uplinkDestination{u}, nil
+}
+
+// uplinkDestination adapts an upload, which stays bound to the context it
+// was started with, to Destination.
+type uplinkDestination struct {
+	*uplink.Upload
+}
+
+func (d uplinkDestination) Commit(ctx context.Context) error {
+	return d.Upload.Commit()
+}
+
+func (d uplinkDestination) Abort(ctx context.Context) error {
+	return d.Upload.Abort()
+}
+
+// FileDestinationOptions configures CreateFileDestination.
+type FileDestinationOptions struct {
+	// MetadataInComment stores the custom metadata as JSON in the archive
+	// comment instead of in a sidecar file.
+	MetadataInComment bool
+
+	// Sidecar is the path of the JSON file the custom metadata is written
+	// to. Empty uses the pack's path followed by ".meta.json".
+	Sidecar string
+}
+
+// FileDestination writes a pack to a local file. The pack is written to a
+// temporary file next to it and only appears at its path on Commit.
+type FileDestination struct {
+	path    string
+	sidecar string // empty if the metadata goes into the comment
+	fh      *os.File
+	custom  uplink.CustomMetadata
+}
+
+// CreateFileDestination creates a destination writing a pack to path.
+func CreateFileDestination(path string, opts *FileDestinationOptions) (*FileDestination, error) {
+	if opts == nil {
+		opts = &FileDestinationOptions{}
+	}
+	d := &FileDestination{path: path}
+	if !opts.MetadataInComment {
+		d.sidecar = opts.Sidecar
+		if d.sidecar == "" {
+			d.sidecar = path + ".meta.json"
+		}
+	}
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	d.fh = fh
+	return d, nil
+}
+
+// Path returns the path the pack is written to.
+func (d *FileDestination) Path() string {
+	return d.path
+}
+
+func (d *FileDestination) Write(p []byte) (int, error) {
+	if d.fh == nil {
+		return 0, errs.Errorf("write to finished destination")
+	}
+	return d.fh.Write(p)
+}
+
+func (d *FileDestination) SetCustomMetadata(ctx context.Context, custom uplink.CustomMetadata) error {
+	d.custom = custom.Clone()
+	return nil
+}
+
+func (d *FileDestination) metadataInComment() bool {
+	return d.sidecar == ""
+}
+
+func (d *FileDestination) metadataComment(custom uplink.CustomMetadata) (string, error) {
+	if !d.metadataInComment() {
+		return "", nil
+	}
+	data, err := json.Marshal(custom)
+	return string(data), err
+}
+
+// Commit moves the pack into place, after writing the sidecar if any.
+func (d *FileDestination) Commit(ctx context.Context) (err error) {
+	if d.fh == nil {
+		return errs.Errorf("destination already finished")
+	}
+	fh := d.fh
+	d.fh = nil
+	defer func() {
+		if err != nil {
+			_ = os.Remove(fh.Name())
+		}
+	}()
+	err = fh.Sync()
+	if err = errs.Combine(err, fh.Close()); err != nil {
+		return err
+	}
+	if d.sidecar != "" {
+		data, err := json.Marshal(d.custom)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(d.sidecar, data); err != nil {
+			return err
+		}
+	}
+	return os.Rename(fh.Name(), d.path)
+}
+
+// Abort removes the partially written pack.
+func (d *FileDestination) Abort(ctx context.Context) error {
+	if d.fh == nil {
+		return nil
+	}
+	fh := d.fh
+	d.fh = nil
+	return errs.Combine(fh.Close(), os.Remove(fh.Name()))
+}
+
+// ReadFileMetadata returns the custom metadata of a pack written with a
+// FileDestination, from the sidecar if given or from the archive comment
+// otherwise.
+func ReadFileMetadata(path, sidecar string) (uplink.CustomMetadata, error) {
+	var data []byte
+	if sidecar != "" {
+		var err error
+		data, err = os.ReadFile(sidecar)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		z, err := zipread.Open(zipread.SourceFromFile(path))
+		if err != nil {
+			return nil, err
+		}
+		comment, _, _, _ := splitTrailer(z.Comment)
+		data = []byte(comment)
+	}
+	var custom uplink.CustomMetadata
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, errs.Errorf("invalid pack metadata: %w", err)
+	}
+	return custom, nil
+}
+
+// MemoryDestination keeps a pack in memory, which is mostly useful for
+// tests.
+type MemoryDestination struct {
+	buf       bytes.Buffer
+	custom    uplink.CustomMetadata
+	committed bool
+	aborted   bool
+}
+
+func (d *MemoryDestination) Write(p []byte) (int, error) {
+	if d.committed || d.aborted {
+		return 0, errs.Errorf("write to finished destination")
+	}
+	return d.buf.Write(p)
+}
+
+func (d *MemoryDestination) SetCustomMetadata(ctx context.Context, custom uplink.CustomMetadata) error {
+	d.custom = custom.Clone()
+	return nil
+}
+
+func (d *MemoryDestination) Commit(ctx context.Context) error {
+	if d.aborted {
+		return errs.Errorf("destination was aborted")
+	}
+	d.committed = true
+	return nil
+}
+
+func (d *MemoryDestination) Abort(ctx context.Context) error {
+	if !d.committed {
+		d.aborted = true
+	}
+	return nil
+}
+
+// Bytes returns the pack written so far.
+func (d *MemoryDestination) Bytes() []byte {
+	return d.buf.Bytes()
+}
+
+// CustomMetadata returns the custom metadata the pack was committed with.
+func (d *MemoryDestination) CustomMetadata() uplink.CustomMetadata {
+	return d.custom
+}
+
+// Committed reports whether the pack was committed.
+func (d *MemoryDestination) Committed() bool {
+	return d.committed
+}
@@ -0,0 +1,80 @@
+package zipper
+
+import (
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/zipper/zipread"
+)
+
+// dosEpoch is the earliest time an MS-DOS timestamp can hold.
+var dosEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// deterministicModTime returns the modification time used for every entry
+// of a deterministic pack.
+func deterministicModTime(t time.Time) (time.Time, error) {
+	if t.IsZero() {
+		t = dosEpoch
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			secs, err := strconv.ParseInt(epoch, 10, 64)
+			if err != nil {
+				return time.Time{}, errs.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+			}
+			t = time.Unix(secs, 0)
+		}
+	}
+	t = t.UTC()
+	if t.Before(dosEpoch) {
+		t = dosEpoch
+	}
+	return t, nil
+}
+
+// normalizeMode keeps only the type of mode and whether it is executable.
+func normalizeMode(mode fs.FileMode) fs.FileMode {
+	switch {
+	case mode.IsDir():
+		return fs.ModeDir | 0755
+	case mode&fs.ModeSymlink != 0:
+		return fs.ModeSymlink | 0777
+	case mode&0111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// normalized returns a copy of h without the attributes a deterministic
+// pack does not store.
+func (h *FileHeader) normalized() *FileHeader {
+	n := *h
+	n.Modified, n.AccessTime, n.CreationTime = time.Time{}, time.Time{}, time.Time{}
+	n.UID, n.GID = 0, 0
+	n.Mode = normalizeMode(h.Mode)
+	return &n
+}
+
+// zipHeader converts options into the header written for the entry name.
+func (p *PendingPack) zipHeader(name string, options *FileHeader) *zipread.FileHeader {
+	if !p.deterministic {
+		return options.zipHeader(name)
+	}
+	header := options.normalized().zipHeader(name)
+	// Only set the MS-DOS timestamp, so that no extended timestamp is added.
+	header.SetModTime(p.modTime)
+	header.Modified = time.Time{}
+	return header
+}
+
+// normalizeRaw drops the attributes a deterministic pack does not store
+// from the header of an entry added with AddRaw.
+func (p *PendingPack) normalizeRaw(header *zipread.FileHeader) {
+	header.Extra = zipread.StripAttributeExtras(header.Extra)
+	header.SetMode(normalizeMode(header.Mode()))
+	header.SetModTime(p.modTime)
+	header.Modified = time.Time{}
+}
@@ -0,0 +1,210 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"storj.io/zipper/zipread"
+)
+
+func buildDeterministic(t *testing.T, fsys fstest.MapFS, concurrency int, stamp time.Time) *MemoryDestination {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, &CreateOptions{
+		Deterministic: true,
+		ModTime:       time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Concurrency:   concurrency,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddFS(ctx, fsys, &AddFSOptions{
+		Header: func(name string, h *FileHeader) { h.Compression = CompressionAuto },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddDir(ctx, "extra/empty", &FileHeader{Modified: stamp, Mode: 0700}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := p.Add(ctx, "extra/stamped.txt", &FileHeader{
+		Modified:     stamp,
+		AccessTime:   stamp,
+		CreationTime: stamp,
+		UID:          1000,
+		GID:          1000,
+		Mode:         0600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, strings.Repeat("stamped ", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !u.Committed() {
+		t.Fatal("upload not committed")
+	}
+	return u
+}
+
+func TestDeterministicPack(t *testing.T) {
+	tree := func(stamp time.Time, perm, exec fs.FileMode) fstest.MapFS {
+		return fstest.MapFS{
+			"a.txt":        {Data: []byte(strings.Repeat("hello ", 1000)), ModTime: stamp, Mode: perm},
+			"b/c.bin":      {Data: bytes.Repeat([]byte{0, 1, 2, 3}, 5000), ModTime: stamp, Mode: perm},
+			"b/run.sh":     {Data: []byte("#!/bin/sh\necho hi\n"), ModTime: stamp, Mode: exec},
+			"b/d/empty.go": {ModTime: stamp, Mode: perm},
+		}
+	}
+	first := time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+	second := time.Now()
+
+	a := buildDeterministic(t, tree(first, 0644, 0755), 0, first)
+	b := buildDeterministic(t, tree(second, 0600, 0700), 4, second)
+	if sha256.Sum256(a.Bytes()) != sha256.Sum256(b.Bytes()) {
+		t.Fatal("two builds of the same tree differ")
+	}
+	if a.CustomMetadata()[directoryOffsetKey] != b.CustomMetadata()[directoryOffsetKey] {
+		t.Fatal("directory offsets differ")
+	}
+
+	changed := tree(first, 0644, 0755)
+	changed["a.txt"].Data[0] = 'j'
+	if c := buildDeterministic(t, changed, 0, first); bytes.Equal(a.Bytes(), c.Bytes()) {
+		t.Fatal("builds of different trees are the same")
+	}
+
+	z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(a.Bytes()), int64(len(a.Bytes()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a.txt":             "-rw-r--r--",
+		"b/":                "drwxr-xr-x",
+		"b/c.bin":           "-rw-r--r--",
+		"b/d/":              "drwxr-xr-x",
+		"b/d/empty.go":      "-rw-r--r--",
+		"b/run.sh":          "-rwxr-xr-x",
+		"extra/empty/":      "drwxr-xr-x",
+		"extra/stamped.txt": "-rw-r--r--",
+	}
+	if len(z.File) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(z.File), len(want))
+	}
+	for _, f := range z.File {
+		if mode := f.Mode().String(); mode != want[f.Name] {
+			t.Errorf("%s: mode %s, want %s", f.Name, mode, want[f.Name])
+		}
+		if !f.Modified.Equal(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: modified %s", f.Name, f.Modified)
+		}
+		if len(f.Extra) != 0 || f.UID != 0 || f.GID != 0 {
+			t.Errorf("%s: unexpected extra fields %x", f.Name, f.Extra)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+		_ = rc.Close()
+	}
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	ctx := context.Background()
+	p, err := CreatePackTo(ctx, new(MemoryDestination), &CreateOptions{Deterministic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/", "a/b.txt", "a/c/", "a/c/d.txt", "a.txt", "b"} {
+		var err error
+		if strings.HasSuffix(name, "/") {
+			err = p.AddDir(ctx, name, nil)
+		} else {
+			_, err = p.Add(ctx, name, nil)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"a/z.txt", "a.bin", "B"} {
+		if _, err := p.Add(ctx, name, nil); !errors.Is(err, ErrNameOrder) {
+			t.Errorf("%s: got %v, want ErrNameOrder", name, err)
+		}
+	}
+	if err := p.AddDir(ctx, "b", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("got %v, want ErrDuplicateName", err)
+	}
+	if _, err := p.Add(ctx, "c", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Abort(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeterministicCopyFrom(t *testing.T) {
+	ctx := context.Background()
+	copyPack := func(stamp time.Time, mode fs.FileMode, uid int) []byte {
+		src := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := p.Add(ctx, "a.txt", &FileHeader{
+			Modified:   stamp,
+			AccessTime: stamp,
+			Mode:       mode,
+			UID:        uid,
+			GID:        uid,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, strings.Repeat("copied ", 100)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		u := new(MemoryDestination)
+		p, err = CreatePackTo(ctx, u, &CreateOptions{Deterministic: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := openMemoryPack(t, src, nil).FileInfo(ctx, "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CopyFrom(ctx, fi.file); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return u.Bytes()
+	}
+
+	a := copyPack(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC), 0600, 1000)
+	b := copyPack(time.Now(), 0640, 2000)
+	if !bytes.Equal(a, b) {
+		t.Fatal("copied entries kept their attributes")
+	}
+	f := readZip(t, a).File[0]
+	if f.Mode() != 0644 || f.UID != 0 || !f.AccessTime.IsZero() || len(f.Extra) != 0 {
+		t.Errorf("got mode %v, owner %d and extra %x", f.Mode(), f.UID, f.Extra)
+	}
+}
@@ -0,0 +1,257 @@
+package zipper
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// AddFSOptions configures PendingPack.AddFS.
+type AddFSOptions struct {
+	// Prefix is prepended to the name of every entry.
+	Prefix string
+
+	// Include, if not empty, limits the files added to those matching at
+	// least one pattern. Paths matching an Exclude pattern are skipped,
+	// along with everything below them. Patterns use path.Match syntax and
+	// are matched against both the slash separated path relative to the
+	// root and its base name.
+	Include []string
+	Exclude []string
+
+	// Header, if set, is called with every entry's name and header before
+	// the entry is added, and may adjust the header, for example to choose
+	// the compression of each file.
+	Header func(name string, header *FileHeader)
+
+	// Progress, if set, is called after every entry is added.
+	Progress func(AddFSProgress)
+
+	// Deterministic ignores the modification times, owners and permissions
+	// found in the file system, other than whether files are executable,
+	// so that the same tree always produces the same entries. Entries are
+	// given ModTime, as with CreateOptions.Deterministic, which
+	// CreatePackFromDir also sets.
+	Deterministic bool
+	ModTime       time.Time
+}
+
+// AddFSProgress reports how far along AddFS is.
+type AddFSProgress struct {
+	Name    string // the entry that was just added
+	Entries int    // entries added so far
+	Bytes   int64  // uncompressed bytes added so far
+}
+
+// ReadLinkFS is a file system that can report the target of a symbolic
+// link. AddFS stores symbolic links as such only if the file system
+// implements it; otherwise links are followed.
+type ReadLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// AddFS adds the tree rooted at fsys to the pack, walking it in lexical
+// order so the same tree always produces the same entry order. Modes,
+// modification times, directories and symbolic links are carried over.
+func (p *PendingPack) AddFS(ctx context.Context, fsys fs.FS, opts *AddFSOptions) error {
+	if opts == nil {
+		opts = &AddFSOptions{}
+	}
+	prefix := opts.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var modTime time.Time
+	if opts.Deterministic {
+		var err error
+		if modTime, err = deterministicModTime(opts.ModTime); err != nil {
+			return err
+		}
+	}
+
+	var progress AddFSProgress
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if matchAny(opts.Exclude, name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		included := len(opts.Include) == 0 || matchAny(opts.Include, name)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		zh, err := zipread.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header := &FileHeader{
+			Modified: info.ModTime(),
+			Mode:     zh.Mode(),
+		}
+		if opts.Deterministic {
+			header = header.normalized()
+			header.Modified = modTime
+		}
+		entry := prefix + name
+
+		var size int64
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if !included {
+				return nil
+			}
+			if opts.Header != nil {
+				opts.Header(entry, header)
+			}
+			if err := p.AddDir(ctx, entry, header); err != nil {
+				return err
+			}
+		case mode&fs.ModeSymlink != 0:
+			if !included {
+				return nil
+			}
+			if lfs, ok := fsys.(ReadLinkFS); ok {
+				target, err := lfs.ReadLink(name)
+				if err != nil {
+					return err
+				}
+				if opts.Header != nil {
+					opts.Header(entry, header)
+				}
+				if size, err = p.addContent(ctx, entry, header, strings.NewReader(target)); err != nil {
+					return err
+				}
+				break
+			}
+			// Without ReadLink, add whatever the link points to.
+			info, err = fs.Stat(fsys, name)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return errs.Errorf("%q: cannot add link to non-regular file", name)
+			}
+			header.Mode = info.Mode()
+			header.Modified = info.ModTime()
+			if opts.Deterministic {
+				header = header.normalized()
+				header.Modified = modTime
+			}
+			fallthrough
+		case mode.IsRegular():
+			if !included {
+				return nil
+			}
+			if opts.Header != nil {
+				opts.Header(entry, header)
+			}
+			if size, err = p.addFile(ctx, fsys, name, entry, header); err != nil {
+				return err
+			}
+		default:
+			return errs.Errorf("%q: cannot add non-regular file", name)
+		}
+
+		progress.Name = entry
+		progress.Entries++
+		progress.Bytes += size
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		return nil
+	})
+}
+
+func (p *PendingPack) addFile(ctx context.Context, fsys fs.FS, name, entry string, header *FileHeader) (_ int64, err error) {
+	fh, err := fsys.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = errs.Combine(err, fh.Close()) }()
+	return p.addContent(ctx, entry, header, fh)
+}
+
+func (p *PendingPack) addContent(ctx context.Context, entry string, header *FileHeader, r io.Reader) (int64, error) {
+	w, err := p.Add(ctx, entry, header)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePackFromDir creates a pack holding the directory tree rooted at
+// dir, as added by AddFS, and commits it.
+func CreatePackFromDir(ctx context.Context, proj *uplink.Project, bucket, key, dir string,
+	options *uplink.UploadOptions, opts *AddFSOptions) error {
+	createOpts := &CreateOptions{Upload: options}
+	if opts != nil && opts.Deterministic {
+		createOpts.Deterministic = true
+		createOpts.ModTime = opts.ModTime
+	}
+	p, err := CreatePackWithOptions(ctx, proj, bucket, key, createOpts)
+	if err != nil {
+		return err
+	}
+	if err := p.AddFS(ctx, DirFS(dir), opts); err != nil {
+		return errs.Combine(err, p.Abort())
+	}
+	return p.Commit(ctx)
+}
+
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+// DirFS returns a file system for the tree rooted at dir, like os.DirFS,
+// that also implements ReadLinkFS.
+func DirFS(dir string) fs.FS {
+	return &dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+func (d *dirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
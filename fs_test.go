@@ -0,0 +1,207 @@
+package zipper
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// linkFS is a MapFS whose symbolic links hold their target as data.
+type linkFS struct{ fstest.MapFS }
+
+func (l linkFS) ReadLink(name string) (string, error) {
+	f, ok := l.MapFS[name]
+	if !ok || f.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return string(f.Data), nil
+}
+
+// followFS is a MapFS that follows symbolic links when stat'ing and
+// opening them, like os.DirFS. It does not embed the MapFS, which would
+// make it a ReadLinkFS.
+type followFS struct{ m fstest.MapFS }
+
+func (f followFS) resolve(name string) string {
+	if file, ok := f.m[name]; ok && file.Mode&fs.ModeSymlink != 0 {
+		return path.Join(path.Dir(name), string(file.Data))
+	}
+	return name
+}
+
+func (f followFS) Open(name string) (fs.File, error) { return f.m.Open(f.resolve(name)) }
+
+func (f followFS) Stat(name string) (fs.FileInfo, error) { return f.m.Stat(f.resolve(name)) }
+
+func addFSPack(t *testing.T, fsys fs.FS, opts *AddFSOptions) *Pack {
+	t.Helper()
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddFS(ctx, fsys, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return openMemoryPack(t, u, nil)
+}
+
+func testTree() fstest.MapFS {
+	modified := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	return fstest.MapFS{
+		"a.txt":          {Data: []byte("a"), Mode: 0644, ModTime: modified},
+		"b.log":          {Data: []byte("bb"), Mode: 0600, ModTime: modified},
+		"docs/c.txt":     {Data: []byte("ccc"), Mode: 0644, ModTime: modified},
+		"docs/d.md":      {Data: []byte("dddd"), Mode: 0755, ModTime: modified},
+		"tmp/e.txt":      {Data: []byte("eeeee"), Mode: 0644, ModTime: modified},
+		"tmp/keep/f.txt": {Data: []byte("ffffff"), Mode: 0644, ModTime: modified},
+	}
+}
+
+func TestAddFS(t *testing.T) {
+	pack := addFSPack(t, testTree(), &AddFSOptions{Prefix: "root"})
+	want := "[root/a.txt root/b.log root/docs/ root/docs/c.txt root/docs/d.md root/tmp/ root/tmp/e.txt root/tmp/keep/ root/tmp/keep/f.txt]"
+	if got := fmt.Sprint(pack.ListAll()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for name, file := range testTree() {
+		if got := readEntry(t, pack, "root/"+name); got != string(file.Data) {
+			t.Errorf("%s: got %q", name, got)
+		}
+		fi, err := pack.FileInfo(context.Background(), "root/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode != file.Mode || !fi.Modified.Equal(file.ModTime) {
+			t.Errorf("%s: got mode %v modified %v", name, fi.Mode, fi.Modified)
+		}
+	}
+}
+
+func TestAddFSFilters(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts AddFSOptions
+		want string
+	}{
+		{
+			name: "include",
+			opts: AddFSOptions{Include: []string{"*.txt"}},
+			want: "[a.txt docs/c.txt tmp/e.txt tmp/keep/f.txt]",
+		},
+		{
+			name: "exclude",
+			opts: AddFSOptions{Exclude: []string{"tmp", "*.log"}},
+			want: "[a.txt docs/ docs/c.txt docs/d.md]",
+		},
+		{
+			name: "exclude path",
+			opts: AddFSOptions{Include: []string{"*.txt", "docs"}, Exclude: []string{"tmp/keep"}},
+			want: "[a.txt docs/ docs/c.txt tmp/e.txt]",
+		},
+	} {
+		pack := addFSPack(t, testTree(), &test.opts)
+		if got := fmt.Sprint(pack.ListAll()); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAddFSCallbacks(t *testing.T) {
+	var headers []string
+	var progress []AddFSProgress
+	pack := addFSPack(t, testTree(), &AddFSOptions{
+		Include: []string{"*.txt"},
+		Header: func(name string, h *FileHeader) {
+			headers = append(headers, name)
+			h.Comment = "from " + name
+			if path.Ext(name) == ".txt" {
+				h.Uncompressed = true
+			}
+		},
+		Progress: func(p AddFSProgress) { progress = append(progress, p) },
+	})
+
+	want := "[a.txt docs/c.txt tmp/e.txt tmp/keep/f.txt]"
+	if got := fmt.Sprint(headers); got != want {
+		t.Errorf("headers for %s, want %s", got, want)
+	}
+	fi, err := pack.FileInfo(context.Background(), "tmp/e.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Comment != "from tmp/e.txt" || !fi.Uncompressed {
+		t.Errorf("header callback was not applied: %+v", fi.FileHeader)
+	}
+
+	if len(progress) != 4 {
+		t.Fatalf("got %d progress reports, want 4", len(progress))
+	}
+	last := progress[len(progress)-1]
+	if last.Name != "tmp/keep/f.txt" || last.Entries != 4 || last.Bytes != 1+3+5+6 {
+		t.Errorf("last progress %+v", last)
+	}
+}
+
+func TestAddFSSymlinks(t *testing.T) {
+	tree := testTree()
+	tree["link.txt"] = &fstest.MapFile{Data: []byte("docs/c.txt"), Mode: fs.ModeSymlink | 0777}
+
+	// Kept as a link by a ReadLinkFS.
+	pack := addFSPack(t, linkFS{tree}, nil)
+	fi, err := pack.FileInfo(context.Background(), "link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("link was not stored as a link: %v", fi.Mode)
+	}
+	if got := readEntry(t, pack, "link.txt"); got != "docs/c.txt" {
+		t.Errorf("link target %q", got)
+	}
+
+	// Followed otherwise.
+	pack = addFSPack(t, followFS{tree}, nil)
+	fi, err = pack.FileInfo(context.Background(), "link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode != 0644 {
+		t.Errorf("followed link has mode %v", fi.Mode)
+	}
+	if got := readEntry(t, pack, "link.txt"); got != "ccc" {
+		t.Errorf("followed link has content %q", got)
+	}
+}
+
+func TestDirFSReadLink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "target.txt"), []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+
+	pack := addFSPack(t, DirFS(dir), nil)
+	fi, err := pack.FileInfo(context.Background(), "link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("link was not stored as a link: %v", fi.Mode)
+	}
+	if got := readEntry(t, pack, "link.txt"); got != "target.txt" {
+		t.Errorf("link target %q", got)
+	}
+}
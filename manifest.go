@@ -0,0 +1,76 @@
+package zipper
+
+import (
+	"context"
+
+	"storj.io/uplink"
+)
+
+// PackManifest describes a committed pack and everything written to it.
+type PackManifest struct {
+	// Object is the committed object, or nil if the pack was not written
+	// to uplink.
+	Object *uplink.Object
+
+	// Size is the size of the archive and DirectoryOffset is where its
+	// central directory starts.
+	Size            int64
+	DirectoryOffset int64
+
+	// Entries lists the entries in the order they appear in the pack.
+	Entries []ManifestEntry
+}
+
+// ManifestEntry describes an entry as it was written to a pack.
+type ManifestEntry struct {
+	Name             string
+	Method           uint16
+	CRC32            uint32
+	CompressedSize   int64
+	UncompressedSize int64
+
+	// HeaderOffset is the offset of the entry's local header, and
+	// ContentOffset is the offset of its (compressed) content.
+	HeaderOffset  int64
+	ContentOffset int64
+}
+
+// Locator returns what OpenEntryAt needs to read the entry back.
+func (e *ManifestEntry) Locator() EntryLocator {
+	return EntryLocator{
+		ContentOffset:  e.ContentOffset,
+		CompressedSize: e.CompressedSize,
+		Method:         e.Method,
+		CRC32:          e.CRC32,
+		Size:           e.UncompressedSize,
+	}
+}
+
+// CommitWithManifest is like Commit, but also returns what was written, so
+// the pack can be indexed without reading it back.
+func (p *PendingPack) CommitWithManifest(ctx context.Context) (*PackManifest, error) {
+	if err := p.Commit(ctx); err != nil {
+		return nil, err
+	}
+	m := &PackManifest{
+		Size:            p.counter.N,
+		DirectoryOffset: p.dirOff,
+		Entries:         make([]ManifestEntry, 0, p.z.NumEntries()),
+	}
+	if u, ok := p.u.(interface{ Info() *uplink.Object }); ok {
+		m.Object = u.Info()
+	}
+	for i, n := 0, p.z.NumEntries(); i < n; i++ {
+		fh, offset := p.z.Entry(i)
+		m.Entries = append(m.Entries, ManifestEntry{
+			Name:             fh.Name,
+			Method:           fh.Method,
+			CRC32:            fh.CRC32,
+			CompressedSize:   int64(fh.CompressedSize64),
+			UncompressedSize: int64(fh.UncompressedSize64),
+			HeaderOffset:     offset,
+			ContentOffset:    p.z.ContentOffset(i),
+		})
+	}
+	return m, nil
+}
@@ -0,0 +1,112 @@
+package zipper
+
+import (
+	"strconv"
+
+	"storj.io/uplink"
+)
+
+// Packs describe themselves in their custom metadata. The layout is
+// versioned, and every earlier version can still be read:
+//
+//   - Version 0 only has directoryOffsetKey, in hexadecimal.
+//   - Version 1 sets versionKey and uses the "zipper:" keys, in decimal.
+//     directoryOffsetKey is still set for readers predating versions.
+//
+// Later versions may add keys, but keep the meaning of existing ones.
+const (
+	metadataVersion = 1
+
+	versionKey          = "zipper:v"
+	dirOffsetKey        = "zipper:dir-offset"
+	dirSizeKey          = "zipper:dir-size"
+	entriesKey          = "zipper:entries"
+	uncompressedSizeKey = "zipper:uncompressed-size"
+
+	directoryOffsetKey = "github.com/jtolio/zipper:diroffset"
+)
+
+// metadataKeys lists the custom metadata keys of every version.
+var metadataKeys = []string{
+	versionKey,
+	dirOffsetKey,
+	dirSizeKey,
+	entriesKey,
+	uncompressedSizeKey,
+	directoryOffsetKey,
+}
+
+// packMetadata is what a pack's custom metadata says about it.
+type packMetadata struct {
+	// version is -1 if the metadata is not a pack's, and dirOffset is -1
+	// if it is unknown.
+	version   int
+	dirOffset int64
+
+	// The stats are only set if hasStats, from version 1 on.
+	hasStats         bool
+	dirSize          int64
+	entries          int64
+	uncompressedSize int64
+}
+
+// parseMetadata reads the pack metadata of any version from custom.
+func parseMetadata(custom uplink.CustomMetadata) packMetadata {
+	if v, ok := custom[versionKey]; ok {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return packMetadata{version: -1, dirOffset: -1}
+		}
+		m := packMetadata{version: version}
+		m.dirOffset = parseInt(custom[dirOffsetKey], 10)
+		m.dirSize = parseInt(custom[dirSizeKey], 10)
+		m.entries = parseInt(custom[entriesKey], 10)
+		m.uncompressedSize = parseInt(custom[uncompressedSizeKey], 10)
+		// Only empty packs have their directory at the start.
+		m.hasStats = (m.dirOffset > 0 || m.dirOffset == 0 && m.entries == 0) &&
+			m.dirSize >= 0 && m.entries >= 0 && m.uncompressedSize >= 0
+		return m
+	}
+
+	m := packMetadata{version: -1, dirOffset: -1}
+	if offset := parseInt(custom[directoryOffsetKey], 16); offset >= 0 {
+		m.version = 0
+		m.dirOffset = offset
+	}
+	return m
+}
+
+// set replaces the pack metadata in custom with m, in the current version.
+func (m *packMetadata) set(custom uplink.CustomMetadata) {
+	for _, key := range metadataKeys {
+		delete(custom, key)
+	}
+	custom[versionKey] = strconv.Itoa(metadataVersion)
+	custom[dirOffsetKey] = strconv.FormatInt(m.dirOffset, 10)
+	custom[dirSizeKey] = strconv.FormatInt(m.dirSize, 10)
+	custom[entriesKey] = strconv.FormatInt(m.entries, 10)
+	custom[uncompressedSizeKey] = strconv.FormatInt(m.uncompressedSize, 10)
+	custom[directoryOffsetKey] = strconv.FormatInt(m.dirOffset, 16)
+}
+
+// directoryMetadata works out the pack metadata of p from its central
+// directory. The version is -1.
+func (p *Pack) directoryMetadata() packMetadata {
+	m := packMetadata{version: -1, hasStats: true}
+	m.dirOffset, m.dirSize = p.zr.Directory()
+	m.entries = int64(p.zr.NumFiles())
+	for i, n := 0, p.zr.NumFiles(); i < n; i++ {
+		m.uncompressedSize += int64(p.zr.FileAt(i).UncompressedSize64)
+	}
+	return m
+}
+
+// parseInt parses a metadata number, returning -1 if it is missing or
+// invalid.
+func parseInt(s string, base int) int64 {
+	v, err := strconv.ParseInt(s, base, 64)
+	if err != nil || v < 0 {
+		return -1
+	}
+	return v
+}
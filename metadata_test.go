@@ -0,0 +1,138 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+func TestParseMetadata(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		custom uplink.CustomMetadata
+		want   packMetadata
+	}{
+		{
+			name:   "none",
+			custom: uplink.CustomMetadata{"owner": "someone"},
+			want:   packMetadata{version: -1, dirOffset: -1},
+		},
+		{
+			name:   "version 0",
+			custom: uplink.CustomMetadata{directoryOffsetKey: "1a2b"},
+			want:   packMetadata{version: 0, dirOffset: 0x1a2b},
+		},
+		{
+			name:   "version 0, empty",
+			custom: uplink.CustomMetadata{directoryOffsetKey: "0"},
+			want:   packMetadata{version: 0, dirOffset: 0},
+		},
+		{
+			name: "version 1",
+			custom: uplink.CustomMetadata{
+				versionKey:          "1",
+				dirOffsetKey:        "6699",
+				dirSizeKey:          "1024",
+				entriesKey:          "16",
+				uncompressedSizeKey: "65535",
+				directoryOffsetKey:  "1a2b",
+			},
+			want: packMetadata{version: 1, dirOffset: 6699, hasStats: true, dirSize: 1024, entries: 16, uncompressedSize: 65535},
+		},
+		{
+			name: "version 1, empty",
+			custom: uplink.CustomMetadata{
+				versionKey:          "1",
+				dirOffsetKey:        "0",
+				dirSizeKey:          "0",
+				entriesKey:          "0",
+				uncompressedSizeKey: "0",
+				directoryOffsetKey:  "0",
+			},
+			want: packMetadata{version: 1, hasStats: true},
+		},
+		{
+			name: "version 1, entries before offset 0",
+			custom: uplink.CustomMetadata{
+				versionKey:          "1",
+				dirOffsetKey:        "0",
+				dirSizeKey:          "46",
+				entriesKey:          "1",
+				uncompressedSizeKey: "0",
+			},
+			want: packMetadata{version: 1, dirSize: 46, entries: 1},
+		},
+		{
+			name:   "future version",
+			custom: uplink.CustomMetadata{versionKey: "7", dirOffsetKey: "6699", "zipper:new": "x"},
+			want:   packMetadata{version: 7, dirOffset: 6699, dirSize: -1, entries: -1, uncompressedSize: -1},
+		},
+		{
+			name:   "invalid version",
+			custom: uplink.CustomMetadata{versionKey: "two", dirOffsetKey: "6699"},
+			want:   packMetadata{version: -1, dirOffset: -1},
+		},
+		{
+			name:   "versioned version 0",
+			custom: uplink.CustomMetadata{versionKey: "0", dirOffsetKey: "6699"},
+			want:   packMetadata{version: -1, dirOffset: -1},
+		},
+	} {
+		if got := parseMetadata(test.custom); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMigratedMetadata(t *testing.T) {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b/c.txt"} {
+		w, err := p.Add(ctx, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, strings.Repeat(name, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddDir(ctx, "d", nil); err != nil {
+		t.Fatal(err)
+	}
+	p.SetCustomMetadata(uplink.CustomMetadata{"owner": "someone"})
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	written := parseMetadata(u.CustomMetadata())
+	if written.version != metadataVersion || !written.hasStats {
+		t.Fatalf("writer recorded %+v", written)
+	}
+
+	// Migrating a pack works the metadata out from its directory, which
+	// has to agree with what the writer recorded.
+	data := u.Bytes()
+	z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (&Pack{zr: z}).directoryMetadata()
+	m.version = metadataVersion
+	if m != written {
+		t.Errorf("directory says %+v, writer recorded %+v", m, written)
+	}
+
+	custom := uplink.CustomMetadata{"owner": "someone", directoryOffsetKey: "1", dirSizeKey: "1"}
+	m.set(custom)
+	if parseMetadata(custom) != written || custom["owner"] != "someone" {
+		t.Errorf("migrated metadata %v", custom)
+	}
+}
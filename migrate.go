@@ -0,0 +1,112 @@
+package zipper
+
+import (
+	"context"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+)
+
+// MigrateOptions configures MigratePack.
+type MigrateOptions struct {
+	// Rewrite uploads the pack again, with RewritePack, instead of only
+	// updating its metadata. The pack then also gains what newer writers
+	// put in the archive itself, such as the directory trailer that lets
+	// it be opened efficiently if its metadata is lost. Entries are copied
+	// without being recompressed.
+	Rewrite bool
+}
+
+// MigratePack brings the metadata of the pack at bucket/key up to the
+// current version, so that it can be opened and stat'ed without guessing.
+// Its other custom metadata is kept. Packs whose metadata is current are
+// left alone unless opts.Rewrite is set. It returns the migrated pack's
+// stats.
+func MigratePack(ctx context.Context, proj *uplink.Project, bucket, key string,
+	opts *MigrateOptions) (*PackStats, error) {
+	return migratePack(ctx, uplinkMigrate{proj: proj}, bucket, key, opts)
+}
+
+// migrateProject is what MigratePack needs from a project, which tests
+// replace.
+type migrateProject interface {
+	statObject(ctx context.Context, bucket, key string) (*uplink.Object, error)
+	openPack(ctx context.Context, bucket, key string, opts *OpenOptions) (*Pack, error)
+	updateMetadata(ctx context.Context, bucket, key string, custom uplink.CustomMetadata) error
+	rewritePack(ctx context.Context, bucket, key string) error
+}
+
+// uplinkMigrate migrates packs in an uplink project.
+type uplinkMigrate struct {
+	proj *uplink.Project
+}
+
+func (m uplinkMigrate) statObject(ctx context.Context, bucket, key string) (*uplink.Object, error) {
+	return m.proj.StatObject(ctx, bucket, key)
+}
+
+func (m uplinkMigrate) openPack(ctx context.Context, bucket, key string, opts *OpenOptions) (*Pack, error) {
+	return OpenPackWithOptions(ctx, m.proj, bucket, key, opts)
+}
+
+func (m uplinkMigrate) updateMetadata(ctx context.Context, bucket, key string, custom uplink.CustomMetadata) error {
+	return m.proj.UpdateObjectMetadata(ctx, bucket, key, custom, nil)
+}
+
+func (m uplinkMigrate) rewritePack(ctx context.Context, bucket, key string) error {
+	return RewritePack(ctx, m.proj, bucket, key, bucket, key, nil)
+}
+
+func migratePack(ctx context.Context, proj migrateProject, bucket, key string,
+	opts *MigrateOptions) (_ *PackStats, err error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	if opts.Rewrite {
+		if err := proj.rewritePack(ctx, bucket, key); err != nil {
+			return nil, err
+		}
+		info, err := proj.statObject(ctx, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		stats, ok := statsFromObject(info)
+		if !ok {
+			return nil, errs.Errorf("pack %q has no recorded stats", key)
+		}
+		return stats, nil
+	}
+
+	info, err := proj.statObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if m := parseMetadata(info.Custom); m.version == metadataVersion && m.hasStats {
+		return m.stats(info.System.ContentLength), nil
+	}
+
+	size := info.System.ContentLength
+	dirOffset := parseMetadata(info.Custom).dirOffset
+	p, err := proj.openPack(ctx, bucket, key, &OpenOptions{
+		Size:                 size,
+		DirectoryOffset:      dirOffset,
+		DirectoryOffsetKnown: dirOffset >= 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = errs.Combine(err, p.Close()) }()
+
+	m := p.directoryMetadata()
+	custom := info.Custom.Clone()
+	m.set(custom)
+	if _, set := custom[contentTypeKey]; !set {
+		custom[contentTypeKey] = contentTypeZip
+	}
+	if err := proj.updateMetadata(ctx, bucket, key, custom); err != nil {
+		return nil, err
+	}
+	m.version = metadataVersion
+	return m.stats(size), nil
+}
@@ -0,0 +1,152 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// fakeMigrate migrates a single stored pack.
+type fakeMigrate struct {
+	store    *storedPack
+	updates  int
+	rewrites int
+}
+
+func (m *fakeMigrate) statObject(ctx context.Context, bucket, key string) (*uplink.Object, error) {
+	return &uplink.Object{
+		Key:    key,
+		System: uplink.SystemMetadata{ContentLength: int64(len(m.store.data))},
+		Custom: m.store.custom.Clone(),
+	}, nil
+}
+
+func (m *fakeMigrate) openPack(ctx context.Context, bucket, key string, opts *OpenOptions) (*Pack, error) {
+	dirOffset := opts.DirectoryOffset
+	if dirOffset < 0 || dirOffset == 0 && !opts.DirectoryOffsetKnown {
+		dirOffset = -1
+	}
+	p, err := openSource(ctx, m.store, opts.Size, dirOffset, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.info, _ = m.statObject(ctx, bucket, key)
+	return p, nil
+}
+
+func (m *fakeMigrate) updateMetadata(ctx context.Context, bucket, key string, custom uplink.CustomMetadata) error {
+	m.updates++
+	m.store.custom = custom.Clone()
+	return nil
+}
+
+func (m *fakeMigrate) rewritePack(ctx context.Context, bucket, key string) error {
+	m.rewrites++
+	plan, err := planEdits(nil)
+	if err != nil {
+		return err
+	}
+	src, err := m.openPack(ctx, bucket, key, &OpenOptions{Size: int64(len(m.store.data))})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	err = plan.rewrite(ctx, src, func() (*PendingPack, error) {
+		return CreatePackTo(ctx, &storeDestination{store: m.store}, nil)
+	})
+	m.store.replaced = false
+	return err
+}
+
+// newVersion0Pack returns a pack as written before pack metadata was
+// versioned: no trailer in the comment, and only the directory offset in
+// its metadata.
+func newVersion0Pack(t *testing.T) *storedPack {
+	buf := new(bytes.Buffer)
+	w := zipread.NewWriter(buf)
+	for _, name := range []string{"a.txt", "dir/", "dir/b.txt"} {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			if _, err := io.WriteString(fw, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.SetComment("old comment"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	z := readZip(t, buf.Bytes())
+	dirOffset, _ := z.Directory()
+	return &storedPack{
+		data: buf.Bytes(),
+		custom: uplink.CustomMetadata{
+			directoryOffsetKey: strconv.FormatInt(dirOffset, 16),
+			"owner":            "someone",
+		},
+	}
+}
+
+func TestMigratePack(t *testing.T) {
+	ctx := context.Background()
+	store := newVersion0Pack(t)
+	data := store.data
+	m := &fakeMigrate{store: store}
+
+	stats, err := migratePack(ctx, m, "bucket", "pack.zip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.updates != 1 || m.rewrites != 0 || !bytes.Equal(store.data, data) {
+		t.Fatalf("migrating in place made %d updates and %d rewrites", m.updates, m.rewrites)
+	}
+	recorded := parseMetadata(store.custom)
+	if recorded.version != metadataVersion || !recorded.hasStats || store.custom["owner"] != "someone" {
+		t.Fatalf("migrated metadata %v", store.custom)
+	}
+	if stats.Entries != 3 || stats.UncompressedSize != 14 || stats.WriterVersion != metadataVersion ||
+		*stats != *recorded.stats(int64(len(data))) {
+		t.Fatalf("got stats %+v, metadata says %+v", stats, recorded)
+	}
+
+	// Migrating again leaves the pack alone.
+	if _, err := migratePack(ctx, m, "bucket", "pack.zip", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.updates != 1 {
+		t.Fatal("current metadata was updated")
+	}
+
+	// Rewriting adds the directory trailer to the archive itself.
+	rewritten, err := migratePack(ctx, m, "bucket", "pack.zip", &MigrateOptions{Rewrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.rewrites != 1 || bytes.Equal(store.data, data) {
+		t.Fatal("pack was not rewritten")
+	}
+	z := readZip(t, store.data)
+	comment, dirOffset, _, ok := splitTrailer(z.Comment)
+	if !ok || comment != "old comment" || store.custom["owner"] != "someone" {
+		t.Fatalf("rewritten pack has comment %q and metadata %v", z.Comment, store.custom)
+	}
+	if rewritten.Entries != 3 || rewritten.DirectoryOffset != dirOffset || rewritten.WriterVersion != metadataVersion {
+		t.Fatalf("got stats %+v after rewriting", rewritten)
+	}
+	for _, f := range z.File {
+		if !f.Mode().IsDir() && readZipFile(t, f) != f.Name {
+			t.Errorf("%s: wrong content", f.Name)
+		}
+	}
+}
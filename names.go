@@ -0,0 +1,119 @@
+package zipper
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrInvalidName is the error of an fs.PathError returned when adding
+	// an entry whose name is not a valid io/fs path, such as an empty or
+	// absolute name, one containing "." or ".." elements, or one with
+	// backslashes.
+	ErrInvalidName = errors.New("invalid entry name")
+
+	// ErrDuplicateName is the error of an fs.PathError returned when adding
+	// an entry whose name is already in the pack. A file and a directory
+	// of the same name count as duplicates, as do a file and the implicit
+	// parent directory of another entry, such as "a" and "a/b".
+	ErrDuplicateName = errors.New("duplicate entry name")
+
+	// ErrNameOrder is the error of an fs.PathError returned when adding an
+	// entry to a deterministic pack whose name does not sort after the
+	// name of the previous entry; see CreateOptions.Deterministic.
+	ErrNameOrder = errors.New("entry name out of order")
+)
+
+// nameKind says what an entry name in a pack stands for.
+type nameKind uint8
+
+const (
+	fileName nameKind = iota + 1
+	dirName
+	parentName // a directory only implied by the entries below it
+)
+
+// entryName checks the name of an entry being added, normalizing it first
+// if the pack does so. Directory names end in a slash. The name has to be
+// reserved once the entry is created.
+func (p *PendingPack) entryName(op, name string) (string, error) {
+	dir := strings.HasSuffix(name, "/")
+	clean := strings.TrimSuffix(name, "/")
+	if p.normalizeNames {
+		clean = normalizeName(clean)
+	}
+	if clean == "." || !fs.ValidPath(clean) || strings.ContainsRune(clean, '\\') {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrInvalidName}
+	}
+	// A directory entry may still be added for a parent directory, but no
+	// entry may go below a file.
+	if kind, taken := p.names[clean]; taken && !(dir && kind == parentName) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrDuplicateName}
+	}
+	for parent := path.Dir(clean); parent != "."; parent = path.Dir(parent) {
+		kind := p.names[parent]
+		if kind == fileName {
+			return "", &fs.PathError{Op: op, Path: name, Err: ErrDuplicateName}
+		}
+		if kind != 0 {
+			break
+		}
+	}
+	if p.deterministic && p.last != "" && !nameLess(p.last, clean) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrNameOrder}
+	}
+	if dir {
+		clean += "/"
+	}
+	return clean, nil
+}
+
+// reserveName records that an entry named name, as returned by entryName,
+// has been created, along with its parent directories.
+func (p *PendingPack) reserveName(name string) {
+	p.last = strings.TrimSuffix(name, "/")
+	p.names[p.last] = fileName
+	if strings.HasSuffix(name, "/") {
+		p.names[p.last] = dirName
+	}
+	for parent := path.Dir(p.last); parent != "."; parent = path.Dir(parent) {
+		if _, ok := p.names[parent]; ok {
+			break
+		}
+		p.names[parent] = parentName
+	}
+}
+
+// normalizeName turns name into a valid io/fs path where possible, the way
+// zipread resolves names: backslashes become slashes, and the name is
+// cleaned as if it were relative to the root, dropping leading slashes and
+// ".." elements that would go above it.
+func normalizeName(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// nameLess reports whether the entry name a sorts before b. Names are
+// compared one path element at a time, so that a directory sorts right
+// before the entries below it, as fs.WalkDir visits them.
+func nameLess(a, b string) bool {
+	for a != "" && b != "" {
+		var ae, be string
+		ae, a = cutElement(a)
+		be, b = cutElement(b)
+		if ae != be {
+			return ae < be
+		}
+	}
+	return a == "" && b != ""
+}
+
+// cutElement splits the first path element off name.
+func cutElement(name string) (elem, rest string) {
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
@@ -0,0 +1,372 @@
+package zipper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/zipper/zipread"
+)
+
+const (
+	defaultMemoryBudget = 64 << 20
+
+	// maxEntryOverhead is what an entry takes in the archive besides its
+	// name, extra fields and content at most: the local header, a Zip64
+	// extra field and a data descriptor.
+	maxEntryOverhead = 30 + 20 + 24
+)
+
+// parallel holds the state of a pack that compresses entries
+// concurrently. Entries are buffered as they are written, compressed by
+// a pool of workers, and written to the archive in the order they were
+// added.
+type parallel struct {
+	budget     *memoryBudget
+	tempDir    string
+	jobs       chan *entryJob
+	pending    []*entryJob // submitted but not yet written, in order
+	maxPending int
+	wg         sync.WaitGroup
+	stop       chan struct{} // closed when the pack is finished
+	closed     bool
+}
+
+// entryJob is an entry waiting to be compressed and written.
+// Directories have neither raw nor data, and entries added with
+// PendingPack.AddRaw only have data.
+type entryJob struct {
+	header *zipread.FileHeader
+	fw     *FileWriter // nil unless added with PendingPack.Add
+	auto   bool        // whether the method is still to be decided
+
+	raw  *spillBuffer // uncompressed content, as written by the caller
+	data *spillBuffer // compressed content, once done
+
+	sum [sha256.Size]byte // content digest, when deduplicating
+	dup bool              // whether an earlier entry has the same content
+
+	done chan struct{}
+	err  error
+}
+
+func newParallel(p *PendingPack, concurrency int, budget int64, tempDir string) *parallel {
+	if budget <= 0 {
+		budget = defaultMemoryBudget
+	}
+	par := &parallel{
+		budget:     &memoryBudget{left: budget},
+		tempDir:    tempDir,
+		jobs:       make(chan *entryJob, 2*concurrency),
+		maxPending: 2 * concurrency,
+		stop:       make(chan struct{}),
+	}
+	par.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer par.wg.Done()
+			for job := range par.jobs {
+				select {
+				case <-par.stop:
+					job.err = errs.Errorf("pack finished")
+				default:
+					job.err = par.compress(p, job)
+				}
+				close(job.done)
+			}
+		}()
+	}
+	return par
+}
+
+func (par *parallel) newBuffer() *spillBuffer {
+	return &spillBuffer{budget: par.budget, tempDir: par.tempDir}
+}
+
+// compress runs on a worker and fills in the compressed content, the
+// CRC-32 and the sizes of job.
+func (par *parallel) compress(p *PendingPack, job *entryJob) error {
+	h := job.header
+	if job.auto {
+		sample := make([]byte, p.autoSampleSize)
+		n, err := io.ReadFull(job.raw.reader(), sample)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		h.Method = p.chooseMethod(h.Name, sample[:n])
+	}
+
+	crc := crc32.NewIEEE()
+	if h.Method == zipread.Store {
+		if _, err := io.Copy(crc, job.raw.reader()); err != nil {
+			return err
+		}
+		job.data = job.raw
+	} else {
+		comp := p.z.Compressor(h.Method)
+		if comp == nil {
+			return zipread.ErrAlgorithm
+		}
+		job.data = par.newBuffer()
+		cw, err := comp(job.data)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.MultiWriter(cw, crc), job.raw.reader())
+		if err = errs.Combine(err, cw.Close()); err != nil {
+			return err
+		}
+		// Release the uncompressed content right away.
+		if err := job.raw.Close(); err != nil {
+			return err
+		}
+	}
+
+	h.CRC32 = crc.Sum32()
+	h.UncompressedSize64 = uint64(job.raw.size)
+	h.CompressedSize64 = uint64(job.data.size)
+	return nil
+}
+
+// submit queues job to be compressed, and writes any entries that are
+// ready. It blocks if too many entries are queued.
+func (p *PendingPack) submit(job *entryJob) error {
+	par := p.par
+	for len(par.pending) >= par.maxPending {
+		if err := p.emit(); err != nil {
+			return err
+		}
+	}
+	par.pending = append(par.pending, job)
+	switch {
+	case job.dup:
+		// There is nothing to compress; see emitDuplicate.
+		if err := job.raw.Close(); err != nil {
+			return err
+		}
+		close(job.done)
+	case job.raw != nil:
+		job.raw.sealed = true
+		par.jobs <- job
+	}
+	for len(par.pending) > 0 {
+		select {
+		case <-par.pending[0].done:
+		default:
+			return nil
+		}
+		if err := p.emit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain writes all queued entries.
+func (p *PendingPack) drain() error {
+	for len(p.par.pending) > 0 {
+		if err := p.emit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emit waits for the oldest queued entry and writes it to the archive.
+func (p *PendingPack) emit() (err error) {
+	par := p.par
+	job := par.pending[0]
+	par.pending = par.pending[1:]
+	<-job.done
+	defer func() { err = errs.Combine(err, job.close()) }()
+	if job.err != nil {
+		return job.err
+	}
+	if job.dup {
+		return p.emitDuplicate(job)
+	}
+
+	if job.data == nil {
+		_, err := p.z.CreateHeader(job.header)
+		return err
+	}
+
+	// Entries added with Add are encoded as if they had been compressed
+	// while writing, so the result does not depend on the concurrency.
+	create := p.z.CreateRaw
+	if job.fw != nil {
+		create = p.z.CreateCompressed
+	}
+	w, err := create(job.header)
+	if err != nil {
+		return err
+	}
+	// Flush the ZIP writer to ensure that p.counter will count the header.
+	if err := p.z.Flush(); err != nil {
+		return err
+	}
+	contentOffset := p.counter.N
+	if _, err := io.Copy(w, job.data.reader()); err != nil {
+		return err
+	}
+	if err := p.z.CloseEntry(); err != nil {
+		return err
+	}
+	if job.fw != nil {
+		job.fw.contentOffset = contentOffset
+		job.fw.addDigest()
+		job.fw.done = true
+		if p.dedup != nil {
+			p.dedup.wrote(job.sum, p.z.NumEntries()-1)
+		}
+	}
+	return nil
+}
+
+// queuedSize returns an upper bound of the size the queued entries take
+// in the archive once written.
+func (par *parallel) queuedSize() int64 {
+	var n int64
+	for _, job := range par.pending {
+		n += maxEntryOverhead + int64(len(job.header.Name)+len(job.header.Extra))
+		switch {
+		case job.raw != nil:
+			// Deflating incompressible content adds five bytes per block.
+			n += job.raw.size + (job.raw.size/65535+1)*5
+		case job.data != nil:
+			n += job.data.size
+		}
+	}
+	return n
+}
+
+// close stops the workers and releases everything still queued.
+func (par *parallel) close() error {
+	if par.closed {
+		return nil
+	}
+	par.closed = true
+	close(par.stop)
+	close(par.jobs)
+	par.wg.Wait()
+	var group errs.Group
+	for _, job := range par.pending {
+		group.Add(job.close())
+	}
+	par.pending = nil
+	return group.Err()
+}
+
+func (job *entryJob) close() error {
+	var group errs.Group
+	if job.raw != nil {
+		group.Add(job.raw.Close())
+	}
+	if job.data != nil {
+		group.Add(job.data.Close())
+	}
+	return group.Err()
+}
+
+// memoryBudget tracks how much memory the buffers of queued entries may
+// still use.
+type memoryBudget struct {
+	mu   sync.Mutex
+	left int64
+}
+
+func (b *memoryBudget) acquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.left += n
+}
+
+// spillBuffer keeps written data in memory while the budget allows, and
+// moves it to a temporary file otherwise.
+type spillBuffer struct {
+	budget  *memoryBudget
+	tempDir string
+
+	mem      []byte
+	reserved int64
+	fh       *os.File
+	name     string // set if fh has to be removed on Close
+	size     int64
+	sealed   bool
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.sealed {
+		return 0, errs.Errorf("write to finished entry")
+	}
+	if b.fh == nil {
+		if b.budget.acquire(int64(len(p))) {
+			b.reserved += int64(len(p))
+			b.mem = append(b.mem, p...)
+			b.size += int64(len(p))
+			return len(p), nil
+		}
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.fh.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *spillBuffer) spill() error {
+	fh, err := os.CreateTemp(b.tempDir, "zipper-entry-*")
+	if err != nil {
+		return err
+	}
+	b.fh = fh
+	// Unlinking an open file is not possible everywhere, in which case
+	// the file is removed on Close instead.
+	if os.Remove(fh.Name()) != nil {
+		b.name = fh.Name()
+	}
+	if _, err := fh.Write(b.mem); err != nil {
+		return err
+	}
+	b.budget.release(b.reserved)
+	b.mem, b.reserved = nil, 0
+	return nil
+}
+
+func (b *spillBuffer) reader() io.Reader {
+	if b.fh != nil {
+		return io.NewSectionReader(b.fh, 0, b.size)
+	}
+	return bytes.NewReader(b.mem)
+}
+
+// Close releases the buffered data. The size is kept.
+func (b *spillBuffer) Close() error {
+	b.budget.release(b.reserved)
+	b.mem, b.reserved = nil, 0
+	if b.fh == nil {
+		return nil
+	}
+	err := b.fh.Close()
+	if b.name != "" {
+		err = errs.Combine(err, os.Remove(b.name))
+	}
+	b.fh, b.name = nil, ""
+	return err
+}
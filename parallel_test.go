@@ -0,0 +1,168 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"storj.io/zipper/zipread"
+)
+
+// buildParallel writes the same varied set of entries with the given
+// options.
+func buildParallel(t *testing.T, opts *CreateOptions) *MemoryDestination {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2021, 7, 8, 9, 10, 11, 0, time.UTC)
+	entries := []struct {
+		name    string
+		header  FileHeader
+		content []byte
+	}{
+		{"text.txt", FileHeader{Modified: modified}, []byte(strings.Repeat("some text ", 20000))},
+		{"stored.bin", FileHeader{Modified: modified, Uncompressed: true}, noisyBytes(4, 50000, 256)},
+		{"auto.bin", FileHeader{Modified: modified, Compression: CompressionAuto}, noisyBytes(5, 50000, 256)},
+		{"auto.txt", FileHeader{Modified: modified, Compression: CompressionAuto}, []byte(strings.Repeat("auto ", 100))},
+		{"ünïcödé/名前.txt", FileHeader{Modified: modified}, []byte("utf-8 name")},
+		{"owned.sh", FileHeader{
+			Modified:     modified,
+			AccessTime:   modified.Add(time.Hour),
+			CreationTime: modified.Add(-time.Hour),
+			Mode:         0750,
+			UID:          1000,
+			GID:          1001,
+			Comment:      "a comment",
+		}, []byte("#!/bin/sh\n")},
+		{"empty.txt", FileHeader{Modified: modified}, nil},
+	}
+	for _, entry := range entries {
+		w, err := p.Add(ctx, entry.name, &entry.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddDir(ctx, "dir", &FileHeader{Modified: modified, Mode: fs.ModeDir | 0700}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func readZip(t *testing.T, data []byte) *zipread.Reader {
+	t.Helper()
+	z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	serial := readZip(t, buildParallel(t, nil).Bytes())
+	for _, concurrency := range []int{2, 8} {
+		parallel := readZip(t, buildParallel(t, &CreateOptions{Concurrency: concurrency}).Bytes())
+		if len(parallel.File) != len(serial.File) {
+			t.Fatalf("concurrency=%d: got %d entries, want %d", concurrency, len(parallel.File), len(serial.File))
+		}
+		for i, want := range serial.File {
+			got := parallel.File[i]
+			if !reflect.DeepEqual(got.FileHeader, want.FileHeader) {
+				t.Errorf("concurrency=%d: %s: header\n%+v\nwant\n%+v", concurrency, want.Name, got.FileHeader, want.FileHeader)
+			}
+			if want.Flags&0x800 == 0 && strings.ContainsAny(want.Name, "üï") {
+				t.Errorf("%s: UTF-8 flag not set", want.Name)
+			}
+			if readZipFile(t, got) != readZipFile(t, want) {
+				t.Errorf("concurrency=%d: %s: wrong content", concurrency, want.Name)
+			}
+		}
+	}
+}
+
+func readZipFile(t *testing.T, f *zipread.File) string {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rc.Close() }()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%s: %v", f.Name, err)
+	}
+	return string(data)
+}
+
+func TestParallelSpills(t *testing.T) {
+	dir := t.TempDir()
+	serial := readZip(t, buildParallel(t, nil).Bytes())
+	// The budget holds none of the larger entries, so they are all
+	// buffered in temporary files.
+	u := buildParallel(t, &CreateOptions{Concurrency: 4, MemoryBudget: 1024, TempDir: dir})
+	parallel := readZip(t, u.Bytes())
+	for i, want := range serial.File {
+		if got := readZipFile(t, parallel.File[i]); got != readZipFile(t, want) {
+			t.Errorf("%s: wrong content", want.Name)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	budget := &memoryBudget{left: 100}
+	b := &spillBuffer{budget: budget, tempDir: t.TempDir()}
+	data := noisyBytes(6, 1000, 256)
+	for _, chunk := range [][]byte{data[:60], data[60:90], data[90:]} {
+		if _, err := b.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.fh == nil || budget.left != 100 {
+		t.Fatalf("buffer did not spill: left %d", budget.left)
+	}
+	got, err := io.ReadAll(b.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || b.size != int64(len(data)) {
+		t.Fatal("spilled buffer has the wrong content")
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	small := &spillBuffer{budget: budget}
+	if _, err := small.Write(data[:40]); err != nil {
+		t.Fatal(err)
+	}
+	if small.fh != nil || budget.left != 60 {
+		t.Fatalf("small buffer spilled or was not counted: left %d", budget.left)
+	}
+	if err := small.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if budget.left != 100 {
+		t.Fatalf("budget was not released: left %d", budget.left)
+	}
+}
@@ -0,0 +1,100 @@
+package zipper
+
+import (
+	"context"
+	"io"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/zipper/zipread"
+)
+
+// AddRaw adds an entry whose content is already compressed. r must provide
+// exactly header.CompressedSize64 bytes, which are written as they are,
+// and header must hold the method, CRC-32 and uncompressed size of the
+// content. It allows moving entries between packs without recompressing
+// them; see also CopyFrom.
+func (p *PendingPack) AddRaw(ctx context.Context, header *zipread.FileHeader, r io.Reader) error {
+	if err := p.finish(p.cur); err != nil {
+		return err
+	}
+	if err := p.checkpoint(ctx); err != nil {
+		return err
+	}
+	h := *header
+	if p.deterministic {
+		p.normalizeRaw(&h)
+	}
+	name, err := p.entryName("add", h.Name)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	size := int64(h.CompressedSize64)
+
+	if p.par != nil {
+		// Keep the entry in order behind those still being compressed.
+		data := p.par.newBuffer()
+		n, err := io.Copy(data, io.LimitReader(r, size))
+		if err == nil && n != size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return errs.Combine(err, data.Close())
+		}
+		done := make(chan struct{})
+		close(done)
+		if err := p.submit(&entryJob{header: &h, data: data, done: done}); err != nil {
+			return err
+		}
+		p.reserveName(name)
+		return nil
+	}
+
+	w, err := p.z.CreateRaw(&h)
+	if err != nil {
+		return err
+	}
+	p.reserveName(name)
+	n, err := io.Copy(w, io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return p.z.CloseEntry()
+}
+
+// CopyFrom adds f, an entry of another archive, without decompressing and
+// recompressing it. The name, method, attributes and extra fields are
+// carried over. Files from a reader using the compact index have no extra
+// fields, so the owner, times and digest parsed from them are written
+// instead.
+func (p *PendingPack) CopyFrom(ctx context.Context, f *zipread.File) (err error) {
+	rc, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, rc.Close()) }()
+	header := f.FileHeader
+	if header.Extra == nil {
+		header.Extra = parsedExtra(f)
+	}
+	return p.AddRaw(ctx, &header, rc)
+}
+
+// parsedExtra rebuilds the extra fields zipread parses from f.
+func parsedExtra(f *zipread.File) []byte {
+	var extra []byte
+	if !f.AccessTime.IsZero() || !f.CreationTime.IsZero() {
+		extra = append(extra, zipread.ExtendedTimeExtra(f.Modified, f.AccessTime, f.CreationTime)...)
+	}
+	if f.UID != 0 || f.GID != 0 {
+		extra = append(extra, zipread.UnixOwnerExtra(f.UID, f.GID)...)
+	}
+	if sum := f.Digest(); sum != nil {
+		extra = append(extra, zipread.DigestExtra(sum)...)
+	}
+	return extra
+}
@@ -2,11 +2,13 @@ package zipper
 
 import (
 	"context"
+	"errors"
 	"io"
 	"io/fs"
 	"log"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/zeebo/errs/v2"
 
@@ -15,16 +17,73 @@ import (
 )
 
 const (
-	directoryOffsetKey = "github.com/jtolio/zipper:diroffset"
 	minTailSearchSize  = 65 * 1024 // the zip reader will guess up to this much
+	maxTailPrefetch    = 64 << 20  // beyond this, the directory is streamed on demand
+	tailSpillThreshold = 8 << 20   // tails larger than this are kept in a temp file
 )
 
+// ErrPackChanged is returned when reading from a pack whose object was
+// replaced after the pack was opened. Objects are told apart by their
+// creation time and size, as this version of uplink has no object
+// versions. Pack.Refresh reopens the pack against the new object.
+var ErrPackChanged = errors.New("pack changed since it was opened")
+
 type Pack struct {
-	info *uplink.Object
-	zr   *zipread.Reader
+	info      *uplink.Object
+	size      int64
+	dirOffset int64 // negative if the pack did not say where its directory is
+	source    zipread.Source
+	zr        *zipread.Reader
+
+	// How the pack was opened, for Refresh.
+	reopen        func(ctx context.Context, opts *OpenOptions) (*Pack, error)
+	opts          OpenOptions
+	decompressors map[uint16]zipread.Decompressor
+}
+
+// OpenOptions configures OpenPackWithOptions.
+type OpenOptions struct {
+	// Size is the object's content length and DirectoryOffset is the
+	// central directory offset that was stored in the pack's metadata.
+	// If both are known, the pack is opened without a StatObject call,
+	// in which case PackInfo returns nil. Zero means unknown, except that
+	// DirectoryOffsetKnown marks a zero DirectoryOffset as known, as it is
+	// for empty packs.
+	// Every download from the pack is checked against the object's size
+	// and creation time, which come from the StatObject call or, if it was
+	// skipped, from the first download; see ErrPackChanged.
+	Size                 int64
+	DirectoryOffset      int64
+	DirectoryOffsetKnown bool
+
+	// MinPrefetch and MaxPrefetch bound how much of the end of the
+	// object is downloaded up front. Zero uses the defaults.
+	MinPrefetch int64
+	MaxPrefetch int64
+
+	// SourceWrappers are applied in order to the Source that reads
+	// from the object, before anything is read through it. They can be
+	// used to add things like zipread.LimitSource or instrumentation.
+	SourceWrappers []func(zipread.Source) zipread.Source
+
+	// CompactIndex keeps the central directory in zipread's compact
+	// form, which is much smaller for packs with many entries. Entries
+	// are described the same either way, but have no raw Extra data.
+	CompactIndex bool
+
+	// VerifyDigests checks the SHA-256 digest recorded for an entry, if
+	// any, once it has been read to EOF. See CreateOptions.Digests.
+	VerifyDigests bool
 }
 
 func OpenPack(ctx context.Context, proj *uplink.Project, bucket, key string) (*Pack, error) {
+	return OpenPackWithOptions(ctx, proj, bucket, key, nil)
+}
+
+// OpenPackWithOptions is like OpenPack, but allows skipping the initial stat
+// when the caller already knows the pack's size and directory offset, and
+// tuning how the pack is read.
+func OpenPackWithOptions(ctx context.Context, proj *uplink.Project, bucket, key string, opts *OpenOptions) (*Pack, error) {
 	// We're going to store Packs as just plain ZIP files. ZIP files are nice because
 	// every file is compressed individually, which means we can decompress single files
 	// relatively efficiently, and they are a very widely supported file type, so users
@@ -75,67 +134,217 @@ func OpenPack(ctx context.Context, proj *uplink.Project, bucket, key string) (*P
 	//    range query logic, maybe we embed Google's Common Expression Language
 	//    or Starlark or Dhall or something.
 
-	info, err := proj.StatObject(ctx, bucket, key)
-	if err != nil {
-		return nil, err
+	if opts == nil {
+		opts = &OpenOptions{}
 	}
 
-	var prefetchAmount int64
-	if offset, err := getOffset(info); err == nil {
-		prefetchAmount = info.System.ContentLength - offset
+	var info *uplink.Object
+	size, dirOffset := opts.Size, opts.DirectoryOffset
+	if dirOffset < 0 || dirOffset == 0 && !opts.DirectoryOffsetKnown {
+		dirOffset = -1
 	}
-	if prefetchAmount < minTailSearchSize {
-		prefetchAmount = minTailSearchSize
+	if size <= 0 || dirOffset < 0 {
+		var err error
+		info, err = proj.StatObject(ctx, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		size = info.System.ContentLength
+		if dirOffset < 0 {
+			dirOffset = parseMetadata(info.Custom).dirOffset
+		}
 	}
+	return openObject(ctx, proj, bucket, key, info, size, dirOffset, opts)
+}
 
-	source, err := zipread.PrefetchTail(ctx, &objectSource{
+// openObject opens the pack at bucket/key, which is size bytes long. info
+// is the result of stat'ing it, if it was, and dirOffset is negative if
+// unknown.
+func openObject(ctx context.Context, proj *uplink.Project, bucket, key string,
+	info *uplink.Object, size, dirOffset int64, opts *OpenOptions) (*Pack, error) {
+	object := &objectSource{
 		proj:   proj,
 		bucket: bucket,
 		key:    key,
-	}, prefetchAmount)
+		size:   size,
+	}
+	if info != nil {
+		object.created = info.System.Created
+	}
+	p, err := openSource(ctx, object, size, dirOffset, opts)
 	if err != nil {
 		return nil, err
 	}
+	p.info = info
+	p.reopen = func(ctx context.Context, opts *OpenOptions) (*Pack, error) {
+		return OpenPackWithOptions(ctx, proj, bucket, key, opts)
+	}
+	p.opts = *opts
+	return p, nil
+}
 
-	zr, err := zipread.Open(source)
+// Refresh reopens the pack against the current version of its object,
+// such as after reading from it failed with ErrPackChanged. The pack is
+// opened with the same options, except that it is always stat'ed, and
+// keeps its registered decompressors. Refresh must not be called while
+// entries of the pack are being read.
+func (p *Pack) Refresh(ctx context.Context) error {
+	if p.reopen == nil {
+		return errs.Errorf("pack was not opened from an object")
+	}
+	opts := p.opts
+	opts.Size, opts.DirectoryOffset, opts.DirectoryOffsetKnown = 0, 0, false
+	fresh, err := p.reopen(ctx, &opts)
+	if err != nil {
+		return err
+	}
+	for method, dcomp := range p.decompressors {
+		fresh.RegisterDecompressor(method, dcomp)
+	}
+	err = p.Close()
+	*p = *fresh
+	return err
+}
+
+// openSource opens the pack read from object, which is size bytes long,
+// after applying opts.SourceWrappers to it. dirOffset is negative if
+// unknown.
+func openSource(ctx context.Context, object zipread.Source, size, dirOffset int64, opts *OpenOptions) (*Pack, error) {
+	for _, wrap := range opts.SourceWrappers {
+		object = wrap(object)
+	}
+
+	minPrefetch, maxPrefetch := opts.MinPrefetch, opts.MaxPrefetch
+	if minPrefetch <= 0 {
+		minPrefetch = minTailSearchSize
+	}
+	if maxPrefetch <= 0 {
+		maxPrefetch = maxTailPrefetch
+	}
+
+	var prefetchAmount int64
+	if dirOffset >= 0 {
+		prefetchAmount = size - dirOffset
+	}
+	if prefetchAmount < minPrefetch {
+		prefetchAmount = minPrefetch
+	}
+
+	prefetchOpts := &zipread.PrefetchOptions{
+		MaxPrefetch:    maxPrefetch,
+		SpillThreshold: tailSpillThreshold,
+	}
+	source, err := zipread.PrefetchTailWithOptions(ctx, object, prefetchAmount, prefetchOpts)
 	if err != nil {
 		return nil, err
 	}
 
+	if dirOffset < 0 {
+		// Without the metadata, the trailer in the archive comment tells
+		// where the directory is. If the guess missed some of it, fetch the
+		// whole directory again with one more request, as if the metadata
+		// had been there.
+		offset, ok, err := readTrailer(ctx, source)
+		if err != nil {
+			return nil, errs.Combine(err, closeSource(source))
+		}
+		if ok {
+			dirOffset = offset
+			if amount := size - dirOffset; amount > prefetchAmount && prefetchAmount < maxPrefetch {
+				if err := closeSource(source); err != nil {
+					return nil, err
+				}
+				source, err = zipread.PrefetchTailWithOptions(ctx, object, amount, prefetchOpts)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	zr, err := zipread.OpenWithOptions(source, &zipread.Options{
+		Compact:       opts.CompactIndex,
+		VerifyDigests: opts.VerifyDigests,
+	})
+	if err != nil {
+		return nil, errs.Combine(err, closeSource(source))
+	}
+
 	return &Pack{
-		info: info,
-		zr:   zr,
+		size:      size,
+		dirOffset: dirOffset,
+		source:    source,
+		zr:        zr,
 	}, nil
 }
 
-func getOffset(info *uplink.Object) (int64, error) {
-	return strconv.ParseInt(info.Custom[directoryOffsetKey], 16, 64)
+// Close releases resources held by the Pack, such as a prefetched
+// central directory that was spilled to disk.
+func (p *Pack) Close() error {
+	return closeSource(p.source)
 }
 
+func closeSource(source zipread.Source) error {
+	if c, ok := source.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RegisterDecompressor registers or overrides the decompressor used for
+// entries with the given method, for packs written with a custom
+// PendingPack.RegisterCompressor.
+func (p *Pack) RegisterDecompressor(method uint16, dcomp zipread.Decompressor) {
+	if p.decompressors == nil {
+		p.decompressors = make(map[uint16]zipread.Decompressor)
+	}
+	p.decompressors[method] = dcomp
+	p.zr.RegisterDecompressor(method, dcomp)
+}
+
+// IsPackagePack reports whether the pack was written by this package,
+// as told by its metadata or its directory trailer.
 func (p *Pack) IsPackagePack() bool {
-	_, err := getOffset(p.info)
-	return err == nil
+	return p.dirOffset >= 0
 }
 
+// PackInfo returns the result of the StatObject call made when opening
+// the pack, or nil if it was skipped.
 func (p *Pack) PackInfo() *uplink.Object {
 	return p.info
 }
 
-// TODO
+// List returns the names of the regular entries in the pack, in the order
+// they were written. See ListAll for directory entries.
 func (p *Pack) List() []string {
-	rv := make([]string, 0, len(p.zr.File))
-	for _, f := range p.zr.File {
-		if !strings.HasSuffix(f.Name, "/") {
+	rv := make([]string, 0, p.zr.NumFiles())
+	for i, n := 0, p.zr.NumFiles(); i < n; i++ {
+		if f := p.zr.FileAt(i); !strings.HasSuffix(f.Name, "/") {
 			rv = append(rv, f.Name)
 		}
 	}
 	return rv
 }
 
+// ListAll returns the names of all entries in the pack, in the order
+// they were written, including directory entries, whose names end in a
+// slash.
+func (p *Pack) ListAll() []string {
+	rv := make([]string, 0, p.zr.NumFiles())
+	for i, n := 0, p.zr.NumFiles(); i < n; i++ {
+		rv = append(rv, p.zr.FileAt(i).Name)
+	}
+	return rv
+}
+
 type FileInfo struct {
 	FileHeader
+	Name string
 	Size int64
 
+	// Digest is the SHA-256 of the content recorded in the pack, if any.
+	Digest []byte
+
 	file *zipread.File
 }
 
@@ -144,15 +353,53 @@ func (p *Pack) FileInfo(ctx context.Context, name string) (*FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newFileInfo(file), nil
+}
+
+// DirInfo returns the directory entry named name, with or without its
+// trailing slash, such as one added with PendingPack.AddDir. Its size is
+// zero and it has no content to open.
+func (p *Pack) DirInfo(ctx context.Context, name string) (*FileInfo, error) {
+	file, err := p.zr.LookupDir(strings.TrimSuffix(name, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(file), nil
+}
+
+// LookupDigest returns the first entry whose recorded SHA-256 digest is sum,
+// whatever its name.
+func (p *Pack) LookupDigest(ctx context.Context, sum []byte) (*FileInfo, error) {
+	file, err := p.zr.LookupDigest(sum)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(file), nil
+}
+
+func newFileInfo(file *zipread.File) *FileInfo {
 	return &FileInfo{
-		FileHeader: FileHeader{
-			Comment:      file.Comment,
-			Modified:     file.Modified,
-			Uncompressed: file.Method == zipread.Store,
-		},
-		Size: int64(file.UncompressedSize64),
-		file: file,
-	}, nil
+		FileHeader: fileHeader(file),
+		Name:       file.Name,
+		Size:       int64(file.UncompressedSize64),
+		Digest:     file.Digest(),
+		file:       file,
+	}
+}
+
+// fileHeader returns the FileHeader describing file.
+func fileHeader(file *zipread.File) FileHeader {
+	return FileHeader{
+		Comment:      file.Comment,
+		Modified:     file.Modified,
+		Uncompressed: file.Method == zipread.Store,
+		Method:       file.Method,
+		Mode:         file.Mode(),
+		UID:          file.UID,
+		GID:          file.GID,
+		AccessTime:   file.AccessTime,
+		CreationTime: file.CreationTime,
+	}
 }
 
 func (fi *FileInfo) Open(ctx context.Context) (*File, error) {
@@ -210,9 +457,64 @@ func (p *Pack) AsFS(ctx context.Context) fs.FS {
 	return p.zr
 }
 
+// EntryLocator is everything needed to read a single pack entry without
+// looking at the pack's central directory. See FileWriter.Locator.
+type EntryLocator struct {
+	ContentOffset  int64
+	CompressedSize int64
+	Method         uint16
+	CRC32          uint32
+	Size           int64
+}
+
+// OpenEntryAt reads a single entry described by loc with one download and
+// no stat. The content is decompressed, and its size and CRC-32 are verified
+// when it has been read to EOF. Custom methods need a decompressor
+// registered with zipread.RegisterDecompressor.
+func OpenEntryAt(ctx context.Context, proj *uplink.Project, bucket, key string, loc EntryLocator) (io.ReadCloser, error) {
+	if loc.ContentOffset < 0 || loc.CompressedSize < 0 || loc.Size < 0 {
+		return nil, errs.Errorf("invalid entry locator")
+	}
+	dl, err := proj.DownloadObject(ctx, bucket, key, &uplink.DownloadOptions{
+		Offset: loc.ContentOffset,
+		Length: loc.CompressedSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rc, err := zipread.NewEntryReader(dl, loc.Method, loc.CRC32, uint64(loc.Size))
+	if err != nil {
+		return nil, errs.Combine(err, dl.Close())
+	}
+	return rc, nil
+}
+
 type objectSource struct {
 	proj        *uplink.Project
 	bucket, key string
+
+	// mu protects the identity of the object the pack was opened from.
+	// Whatever is not known from the stat is set by the first download.
+	mu      sync.Mutex
+	created time.Time
+	size    int64
+}
+
+// check returns ErrPackChanged if info is not the object the pack was
+// opened from.
+func (o *objectSource) check(info *uplink.Object) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.created.IsZero() {
+		o.created = info.System.Created
+	}
+	if o.size <= 0 {
+		o.size = info.System.ContentLength
+	}
+	if !info.System.Created.Equal(o.created) || info.System.ContentLength != o.size {
+		return errs.Errorf("%q: %w", o.key, ErrPackChanged)
+	}
+	return nil
 }
 
 func (o *objectSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
@@ -227,6 +529,9 @@ func (o *objectSource) Range(ctx context.Context, offset, length int64) (io.Read
 	if err != nil {
 		return nil, err
 	}
+	if err := o.check(dl.Info()); err != nil {
+		return nil, errs.Combine(err, dl.Close())
+	}
 	return dl, nil
 }
 
@@ -242,6 +547,9 @@ func (o *objectSource) RangeFromEnd(ctx context.Context, length int64) (rc io.Re
 	if err != nil {
 		return nil, 0, err
 	}
+	if err := o.check(dl.Info()); err != nil {
+		return nil, 0, errs.Combine(err, dl.Close())
+	}
 	log.Printf("got range from end with overall length %d", dl.Info().System.ContentLength)
 	return dl, dl.Info().System.ContentLength, nil
 }
@@ -0,0 +1,431 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+func TestObjectSourceCheck(t *testing.T) {
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	object := func(created time.Time, size int64) *uplink.Object {
+		return &uplink.Object{Key: "pack.zip", System: uplink.SystemMetadata{
+			Created:       created,
+			ContentLength: size,
+		}}
+	}
+
+	// Pinned from the stat.
+	o := &objectSource{key: "pack.zip", created: created, size: 100}
+	if err := o.check(object(created, 100)); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range []*uplink.Object{
+		object(created.Add(time.Second), 100),
+		object(created, 101),
+	} {
+		if err := o.check(info); !errors.Is(err, ErrPackChanged) {
+			t.Fatalf("got %v, want ErrPackChanged", err)
+		}
+	}
+
+	// Pinned from the first download.
+	o = &objectSource{key: "pack.zip"}
+	if err := o.check(object(created, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.check(object(created.Add(time.Second), 100)); !errors.Is(err, ErrPackChanged) {
+		t.Fatalf("got %v, want ErrPackChanged", err)
+	}
+}
+
+// recordingSource records the lengths requested from the end of a Source.
+type recordingSource struct {
+	zipread.Source
+	fromEnd []int64
+	ranges  int
+}
+
+func (s *recordingSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.ranges++
+	return s.Source.Range(ctx, offset, length)
+}
+
+func (s *recordingSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	s.fromEnd = append(s.fromEnd, length)
+	return s.Source.RangeFromEnd(ctx, length)
+}
+
+func TestOpenOptions(t *testing.T) {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := p.Add(ctx, fmt.Sprintf("entry-%04d.txt", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data := u.Bytes()
+	size := int64(len(data))
+	dirOffset := parseMetadata(u.CustomMetadata()).dirOffset
+
+	open := func(opts OpenOptions) (*Pack, *recordingSource) {
+		source := &recordingSource{Source: zipread.SourceFromReaderAt(bytes.NewReader(data), size)}
+		opts.Size, opts.DirectoryOffset = size, dirOffset
+		// The wrapper replaces the object entirely, and without a project
+		// a stat would panic, so this checks the stat is skipped too.
+		opts.SourceWrappers = append(opts.SourceWrappers, func(zipread.Source) zipread.Source { return source })
+		pack, err := OpenPackWithOptions(ctx, nil, "bucket", "pack.zip", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pack.List()) != 1000 || !pack.IsPackagePack() || pack.PackInfo() != nil {
+			t.Fatalf("got %d entries", len(pack.List()))
+		}
+		return pack, source
+	}
+
+	pack, source := open(OpenOptions{})
+	if len(source.fromEnd) != 1 || source.fromEnd[0] != minTailSearchSize || source.ranges != 0 {
+		t.Errorf("default: got requests %v and %d ranges", source.fromEnd, source.ranges)
+	}
+	_ = pack.Close()
+
+	pack, source = open(OpenOptions{MinPrefetch: size})
+	if len(source.fromEnd) != 1 || source.fromEnd[0] != size || source.ranges != 0 {
+		t.Errorf("min prefetch: got requests %v and %d ranges", source.fromEnd, source.ranges)
+	}
+	_ = pack.Close()
+
+	pack, source = open(OpenOptions{MaxPrefetch: 1024})
+	if len(source.fromEnd) != 1 || source.fromEnd[0] != 1024 || source.ranges == 0 {
+		t.Errorf("max prefetch: got requests %v and %d ranges", source.fromEnd, source.ranges)
+	}
+	_ = pack.Close()
+}
+
+func TestIsPackagePackEmpty(t *testing.T) {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data := u.Bytes()
+	dirOffset := parseMetadata(u.CustomMetadata()).dirOffset
+	if dirOffset != 0 {
+		t.Fatalf("got directory offset %d for an empty pack", dirOffset)
+	}
+
+	// From the metadata, and from the trailer.
+	for _, offset := range []int64{dirOffset, -1} {
+		source := zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		pack, err := openSource(ctx, source, int64(len(data)), offset, &OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pack.IsPackagePack() {
+			t.Errorf("offset %d: empty pack is not a package pack", offset)
+		}
+		_ = pack.Close()
+	}
+
+	// A known offset of zero skips the stat, which would panic without a
+	// project, and the search for the directory.
+	source := &recordingSource{Source: zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))}
+	pack, err := OpenPackWithOptions(ctx, nil, "bucket", "pack.zip", &OpenOptions{
+		Size:                 int64(len(data)),
+		DirectoryOffsetKnown: true,
+		SourceWrappers:       []func(zipread.Source) zipread.Source{func(zipread.Source) zipread.Source { return source }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(source.fromEnd) != 1 || source.ranges != 0 || !pack.IsPackagePack() {
+		t.Errorf("got requests %v and %d ranges", source.fromEnd, source.ranges)
+	}
+	_ = pack.Close()
+}
+
+func TestDirectoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	modified := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"tree":             {Mode: fs.ModeDir | 0750, ModTime: modified},
+		"tree/empty":       {Mode: fs.ModeDir | 0700, ModTime: modified.Add(time.Hour)},
+		"tree/shared":      {Mode: fs.ModeDir | fs.ModeSetgid | 0755, ModTime: modified},
+		"tree/tmp":         {Mode: fs.ModeDir | fs.ModeSticky | 0777, ModTime: modified},
+		"tree/file.txt":    {Data: []byte("hello"), Mode: 0640, ModTime: modified},
+		"tree/sub/a.txt":   {Data: []byte("a"), Mode: 0644, ModTime: modified},
+		"tree/sub":         {Mode: fs.ModeDir | 0755, ModTime: modified},
+		"tree/sub/b/c.txt": {Data: []byte("c"), Mode: 0644, ModTime: modified},
+	}
+
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddFS(ctx, fsys, nil); err != nil {
+		t.Fatal(err)
+	}
+	owned := &FileHeader{Mode: fs.ModeDir | 0711, UID: 1000, GID: 2000, Modified: modified, AccessTime: modified.Add(time.Minute)}
+	if err := p.AddDir(ctx, "owned", owned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add(ctx, "implied/file.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data := u.Bytes()
+
+	for _, compact := range []bool{false, true} {
+		source := zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		pack, err := openSource(ctx, source, int64(len(data)), -1, &OpenOptions{CompactIndex: compact})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantAll := []string{"tree/", "tree/empty/", "tree/file.txt", "tree/shared/", "tree/sub/", "tree/sub/a.txt", "tree/sub/b/", "tree/sub/b/c.txt", "tree/tmp/", "owned/", "implied/file.txt"}
+		if got := pack.ListAll(); fmt.Sprint(got) != fmt.Sprint(wantAll) {
+			t.Errorf("compact=%v: ListAll got %v, want %v", compact, got, wantAll)
+		}
+		if got := pack.List(); len(got) != 4 {
+			t.Errorf("compact=%v: List got %v", compact, got)
+		}
+
+		for name, file := range fsys {
+			if !file.Mode.IsDir() {
+				continue
+			}
+			for _, lookup := range []string{name, name + "/"} {
+				fi, err := pack.DirInfo(ctx, lookup)
+				if err != nil {
+					t.Fatalf("compact=%v: %q: %v", compact, lookup, err)
+				}
+				if fi.Mode != file.Mode || !fi.Modified.Equal(file.ModTime) || fi.Size != 0 {
+					t.Errorf("compact=%v: %q: got mode %v modified %v", compact, lookup, fi.Mode, fi.Modified)
+				}
+			}
+		}
+
+		fi, err := pack.DirInfo(ctx, "owned")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode != owned.Mode {
+			t.Errorf("compact=%v: owned: got mode %v", compact, fi.Mode)
+		}
+		if fi.UID != owned.UID || fi.GID != owned.GID || !fi.AccessTime.Equal(owned.AccessTime) {
+			t.Errorf("compact=%v: owned: got %d:%d accessed %v", compact, fi.UID, fi.GID, fi.AccessTime)
+		}
+
+		// implied has no entry of its own, and files are not directories.
+		for _, name := range []string{"implied", "tree/file.txt", "missing"} {
+			if _, err := pack.DirInfo(ctx, name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("compact=%v: %q: got %v, want ErrNotExist", compact, name, err)
+			}
+		}
+		_ = pack.Close()
+	}
+}
+
+func TestCompactIndexFileInfo(t *testing.T) {
+	ctx := context.Background()
+	modified := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	header := &FileHeader{
+		Comment:      "a comment",
+		Modified:     modified,
+		Mode:         0750,
+		UID:          1000,
+		GID:          2000,
+		AccessTime:   modified.Add(time.Minute),
+		CreationTime: modified.Add(-time.Hour),
+	}
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, &CreateOptions{Digests: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := p.Add(ctx, "file.txt", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	describe := func(pack *Pack) (*FileInfo, string) {
+		t.Helper()
+		fi, err := pack.FileInfo(ctx, "file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		described := *fi
+		described.file = nil
+		return fi, fmt.Sprintf("%+v", described)
+	}
+	_, want := describe(openMemoryPack(t, u, nil))
+	fi, got := describe(openMemoryPack(t, u, &OpenOptions{CompactIndex: true}))
+	if got != want {
+		t.Errorf("compact index:\n got %s\nwant %s", got, want)
+	}
+
+	// Copying from the compact index writes the same attributes.
+	copied := new(MemoryDestination)
+	p, err = CreatePackTo(ctx, copied, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CopyFrom(ctx, fi.file); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := describe(openMemoryPack(t, copied, nil)); got != want {
+		t.Errorf("copied from the compact index:\n got %s\nwant %s", got, want)
+	}
+}
+
+// openMemoryPack opens the pack written to u.
+func openMemoryPack(t *testing.T, u *MemoryDestination, opts *OpenOptions) *Pack {
+	t.Helper()
+	if opts == nil {
+		opts = &OpenOptions{}
+	}
+	data := u.Bytes()
+	source := zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))
+	pack, err := openSource(context.Background(), source, int64(len(data)), -1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pack.Close() })
+	return pack
+}
+
+// readEntry returns the content of the named entry of pack.
+func readEntry(t *testing.T, pack *Pack, name string) string {
+	t.Helper()
+	f, err := pack.Open(context.Background(), name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer func() { _ = f.Close() }()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return string(data)
+}
+
+// pinnedSource reads a storedPack as it was when the source was created,
+// failing with ErrPackChanged once it has been replaced.
+type pinnedSource struct {
+	store *storedPack
+	data  []byte
+}
+
+func (s *pinnedSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if !bytes.Equal(s.store.data, s.data) {
+		return nil, ErrPackChanged
+	}
+	return zipread.SourceFromReaderAt(bytes.NewReader(s.data), int64(len(s.data))).Range(ctx, offset, length)
+}
+
+func (s *pinnedSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	if !bytes.Equal(s.store.data, s.data) {
+		return nil, 0, ErrPackChanged
+	}
+	return zipread.SourceFromReaderAt(bytes.NewReader(s.data), int64(len(s.data))).RangeFromEnd(ctx, length)
+}
+
+// openPinned opens the current version of store the way OpenPack opens
+// an object, so that the pack can be refreshed.
+func openPinned(ctx context.Context, store *storedPack, opts *OpenOptions) (*Pack, error) {
+	source := &pinnedSource{store: store, data: store.data}
+	p, err := openSource(ctx, source, int64(len(store.data)), -1, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.reopen = func(ctx context.Context, opts *OpenOptions) (*Pack, error) {
+		return openPinned(ctx, store, opts)
+	}
+	p.opts = *opts
+	return p, nil
+}
+
+func TestPackRefresh(t *testing.T) {
+	ctx := context.Background()
+	// The content is larger than the prefetched tail, so reading it
+	// downloads from the object.
+	pack := func(content []byte) []byte {
+		u := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := p.Add(ctx, "big.bin", &FileHeader{Compression: CompressionStore})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return u.Bytes()
+	}
+	first, second := noisyBytes(1, 200000, 256), noisyBytes(2, 300000, 256)
+
+	store := &storedPack{data: pack(first)}
+	p, err := openPinned(ctx, store, &OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close() }()
+	if readEntry(t, p, "big.bin") != string(first) {
+		t.Fatal("wrong content")
+	}
+
+	store.data = pack(second)
+	f, err := p.Open(ctx, "big.bin")
+	if err == nil {
+		_, err = io.ReadAll(f)
+		_ = f.Close()
+	}
+	if !errors.Is(err, ErrPackChanged) {
+		t.Fatalf("reading a replaced pack: got %v, want ErrPackChanged", err)
+	}
+
+	if err := p.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if readEntry(t, p, "big.bin") != string(second) {
+		t.Error("wrong content after refreshing")
+	}
+}
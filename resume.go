@@ -0,0 +1,436 @@
+package zipper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+const (
+	defaultPartSize = 64 << 20
+	journalVersion  = 1
+)
+
+// journal is the progress of a resumable pack upload, as saved to the
+// journal file after every part.
+type journal struct {
+	Version  int    `json:"version"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+
+	// Parts is the number of committed parts, which are numbered from 1,
+	// and Offset is how many bytes they hold.
+	Parts  int   `json:"parts"`
+	Offset int64 `json:"offset"`
+
+	// Entries lists the entries in the committed parts, followed by those
+	// in the part being uploaded. Done is how many are committed.
+	Entries []journalEntry `json:"entries"`
+	Done    int            `json:"done"`
+
+	// PendingSize is the size of the part being uploaded, if any.
+	PendingSize int64 `json:"pending_size,omitempty"`
+}
+
+// journalEntry is what the central directory needs to know about an entry
+// that has been written.
+type journalEntry struct {
+	Name               string `json:"name"`
+	Comment            string `json:"comment,omitempty"`
+	NonUTF8            bool   `json:"non_utf8,omitempty"`
+	CreatorVersion     uint16 `json:"creator_version"`
+	ReaderVersion      uint16 `json:"reader_version"`
+	Flags              uint16 `json:"flags"`
+	Method             uint16 `json:"method"`
+	ModifiedTime       uint16 `json:"modified_time"`
+	ModifiedDate       uint16 `json:"modified_date"`
+	CRC32              uint32 `json:"crc32"`
+	CompressedSize64   uint64 `json:"compressed_size"`
+	UncompressedSize64 uint64 `json:"uncompressed_size"`
+	Extra              []byte `json:"extra,omitempty"`
+	ExternalAttrs      uint32 `json:"external_attrs"`
+	Offset             int64  `json:"offset"`
+	ContentOffset      int64  `json:"content_offset"`
+
+	// Digest is the SHA-256 of the content of entries that later entries
+	// of a pack using CreateOptions.Dedup may share.
+	Digest []byte `json:"digest,omitempty"`
+}
+
+func newJournalEntry(fh *zipread.FileHeader, offset, contentOffset int64) journalEntry {
+	return journalEntry{
+		Name:               fh.Name,
+		Comment:            fh.Comment,
+		NonUTF8:            fh.NonUTF8,
+		CreatorVersion:     fh.CreatorVersion,
+		ReaderVersion:      fh.ReaderVersion,
+		Flags:              fh.Flags,
+		Method:             fh.Method,
+		ModifiedTime:       fh.ModifiedTime,
+		ModifiedDate:       fh.ModifiedDate,
+		CRC32:              fh.CRC32,
+		CompressedSize64:   fh.CompressedSize64,
+		UncompressedSize64: fh.UncompressedSize64,
+		Extra:              fh.Extra,
+		ExternalAttrs:      fh.ExternalAttrs,
+		Offset:             offset,
+		ContentOffset:      contentOffset,
+	}
+}
+
+func (e *journalEntry) header() *zipread.FileHeader {
+	return &zipread.FileHeader{
+		Name:               e.Name,
+		Comment:            e.Comment,
+		NonUTF8:            e.NonUTF8,
+		CreatorVersion:     e.CreatorVersion,
+		ReaderVersion:      e.ReaderVersion,
+		Flags:              e.Flags,
+		Method:             e.Method,
+		ModifiedTime:       e.ModifiedTime,
+		ModifiedDate:       e.ModifiedDate,
+		CRC32:              e.CRC32,
+		CompressedSize:     clampUint32(e.CompressedSize64),
+		UncompressedSize:   clampUint32(e.UncompressedSize64),
+		CompressedSize64:   e.CompressedSize64,
+		UncompressedSize64: e.UncompressedSize64,
+		Extra:              e.Extra,
+		ExternalAttrs:      e.ExternalAttrs,
+	}
+}
+
+func clampUint32(v uint64) uint32 {
+	if v > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
+
+func loadJournal(path string) (*journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, errs.Errorf("invalid journal %q: %w", path, err)
+	}
+	if j.Version != journalVersion {
+		return nil, errs.Errorf("journal %q has unsupported version %d", path, j.Version)
+	}
+	if j.Done < 0 || j.Done > len(j.Entries) {
+		return nil, errs.Errorf("invalid journal %q: bad entry count", path)
+	}
+	return &j, nil
+}
+
+// save replaces the journal file at path atomically.
+func (j *journal) save(path string) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old or the new content.
+func writeFileAtomic(path string, data []byte) (err error) {
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(fh.Name())
+		}
+	}()
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err = errs.Combine(err, fh.Close()); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// multipartProject is what resumable uploads need from a project, which
+// tests replace.
+type multipartProject interface {
+	beginUpload(ctx context.Context, bucket, key string, options *uplink.UploadOptions) (uploadID string, err error)
+	uploadPart(ctx context.Context, bucket, key, uploadID string, number uint32, data io.Reader) error
+	listParts(ctx context.Context, bucket, key, uploadID string) (map[uint32]int64, error)
+	commitUpload(ctx context.Context, bucket, key, uploadID string, custom uplink.CustomMetadata) (*uplink.Object, error)
+	abortUpload(ctx context.Context, bucket, key, uploadID string) error
+}
+
+// uplinkMultipart makes multipart uploads to an uplink project.
+type uplinkMultipart struct {
+	proj *uplink.Project
+}
+
+func (m uplinkMultipart) beginUpload(ctx context.Context, bucket, key string,
+	options *uplink.UploadOptions) (string, error) {
+	info, err := m.proj.BeginUpload(ctx, bucket, key, options)
+	if err != nil {
+		return "", err
+	}
+	return info.UploadID, nil
+}
+
+func (m uplinkMultipart) uploadPart(ctx context.Context, bucket, key, uploadID string, number uint32,
+	data io.Reader) error {
+	pu, err := m.proj.UploadPart(ctx, bucket, key, uploadID, number)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(pu, data); err != nil {
+		return errs.Combine(err, pu.Abort())
+	}
+	return pu.Commit()
+}
+
+func (m uplinkMultipart) listParts(ctx context.Context, bucket, key, uploadID string) (map[uint32]int64, error) {
+	parts := make(map[uint32]int64)
+	it := m.proj.ListUploadParts(ctx, bucket, key, uploadID, nil)
+	for it.Next() {
+		part := it.Item()
+		parts[part.PartNumber] = part.Size
+	}
+	return parts, it.Err()
+}
+
+func (m uplinkMultipart) commitUpload(ctx context.Context, bucket, key, uploadID string,
+	custom uplink.CustomMetadata) (*uplink.Object, error) {
+	return m.proj.CommitUpload(ctx, bucket, key, uploadID, &uplink.CommitUploadOptions{
+		CustomMetadata: custom,
+	})
+}
+
+func (m uplinkMultipart) abortUpload(ctx context.Context, bucket, key, uploadID string) error {
+	return m.proj.AbortUpload(ctx, bucket, key, uploadID)
+}
+
+// multipartUpload is an upload made of parts cut at entry boundaries,
+// whose progress is saved to a journal so it can be resumed.
+type multipartUpload struct {
+	proj     multipartProject
+	path     string
+	state    *journal
+	partSize int64
+	budget   *memoryBudget
+	tempDir  string
+	part     *spillBuffer // data not yet uploaded
+	custom   uplink.CustomMetadata
+	info     *uplink.Object // set once committed
+}
+
+func newMultipartUpload(proj multipartProject, path string, state *journal,
+	opts *CreateOptions) *multipartUpload {
+	budget := opts.MemoryBudget
+	if budget <= 0 {
+		budget = defaultMemoryBudget
+	}
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	u := &multipartUpload{
+		proj:     proj,
+		path:     path,
+		state:    state,
+		partSize: partSize,
+		budget:   &memoryBudget{left: budget},
+		tempDir:  opts.TempDir,
+	}
+	u.part = u.newBuffer()
+	return u
+}
+
+func (u *multipartUpload) newBuffer() *spillBuffer {
+	return &spillBuffer{budget: u.budget, tempDir: u.tempDir}
+}
+
+func (u *multipartUpload) Write(p []byte) (int, error) {
+	return u.part.Write(p)
+}
+
+func (u *multipartUpload) SetCustomMetadata(ctx context.Context, custom uplink.CustomMetadata) error {
+	u.custom = custom.Clone()
+	return nil
+}
+
+// checkpoint is called between entries, once all of them have been
+// written, and uploads a part if enough data is buffered.
+func (u *multipartUpload) checkpoint(ctx context.Context, z *zipread.Writer, d *dedup) error {
+	if u.part.size < u.partSize {
+		return nil
+	}
+	u.state.Entries = u.state.Entries[:u.state.Done]
+	for i := u.state.Done; i < z.NumEntries(); i++ {
+		fh, offset := z.Entry(i)
+		e := newJournalEntry(fh, offset, z.ContentOffset(i))
+		e.Digest = d.digest(i)
+		u.state.Entries = append(u.state.Entries, e)
+	}
+	return u.uploadPart(ctx)
+}
+
+// uploadPart uploads the buffered data as the next part, saving the
+// journal before and after.
+func (u *multipartUpload) uploadPart(ctx context.Context) error {
+	size := u.part.size
+	if size == 0 {
+		return nil
+	}
+	u.state.PendingSize = size
+	if err := u.state.save(u.path); err != nil {
+		return err
+	}
+
+	s := u.state
+	if err := u.proj.uploadPart(ctx, s.Bucket, s.Key, s.UploadID, uint32(s.Parts+1), u.part.reader()); err != nil {
+		return err
+	}
+
+	s.Parts++
+	s.Offset += size
+	s.Done = len(s.Entries)
+	s.PendingSize = 0
+	if err := s.save(u.path); err != nil {
+		return err
+	}
+	err := u.part.Close()
+	u.part = u.newBuffer()
+	return err
+}
+
+func (u *multipartUpload) Commit(ctx context.Context) error {
+	if err := u.uploadPart(ctx); err != nil {
+		return err
+	}
+	s := u.state
+	info, err := u.proj.commitUpload(ctx, s.Bucket, s.Key, s.UploadID, u.custom)
+	if err != nil {
+		return err
+	}
+	u.info = info
+	return os.Remove(u.path)
+}
+
+// Info returns the committed object, like uplink.Upload.Info.
+func (u *multipartUpload) Info() *uplink.Object {
+	return u.info
+}
+
+func (u *multipartUpload) Abort(ctx context.Context) error {
+	s := u.state
+	err := u.proj.abortUpload(ctx, s.Bucket, s.Key, s.UploadID)
+	err = errs.Combine(err, u.part.Close())
+	if err == nil {
+		err = os.Remove(u.path)
+	}
+	return err
+}
+
+// createResumable starts a resumable upload for CreatePackWithOptions.
+func createResumable(ctx context.Context, proj multipartProject, bucket, key string,
+	opts *CreateOptions) (*multipartUpload, error) {
+	if _, err := os.Stat(opts.Journal); err == nil {
+		return nil, errs.Errorf("journal %q already exists; use ResumePack", opts.Journal)
+	}
+	uploadID, err := proj.beginUpload(ctx, bucket, key, opts.Upload)
+	if err != nil {
+		return nil, err
+	}
+	state := &journal{
+		Version:  journalVersion,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	}
+	if err := state.save(opts.Journal); err != nil {
+		return nil, errs.Combine(err, proj.abortUpload(ctx, bucket, key, uploadID))
+	}
+	return newMultipartUpload(proj, opts.Journal, state, opts), nil
+}
+
+// ResumePack continues the resumable pack upload recorded in opts.Journal,
+// which was started by CreatePackWithOptions. Entries that were not yet in
+// an uploaded part are lost; Entries tells which ones were kept, and the
+// rest have to be added again. opts should otherwise match the options the
+// pack was created with.
+func ResumePack(ctx context.Context, proj *uplink.Project, opts *CreateOptions) (*PendingPack, error) {
+	return resumePack(ctx, uplinkMultipart{proj: proj}, opts)
+}
+
+func resumePack(ctx context.Context, proj multipartProject, opts *CreateOptions) (*PendingPack, error) {
+	if opts == nil || opts.Journal == "" {
+		return nil, errs.Errorf("no journal to resume from")
+	}
+	state, err := loadJournal(opts.Journal)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := proj.listParts(ctx, state.Bucket, state.Key, state.UploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The part being uploaded counts if it made it.
+	pending := uint32(state.Parts + 1)
+	if size, ok := parts[pending]; ok && state.PendingSize > 0 && size == state.PendingSize {
+		state.Parts++
+		state.Offset += size
+		state.Done = len(state.Entries)
+	}
+	state.Entries = state.Entries[:state.Done]
+	state.PendingSize = 0
+
+	var total int64
+	for number, size := range parts {
+		if number < 1 || number > uint32(state.Parts) {
+			return nil, errs.Errorf("upload has unexpected part %d", number)
+		}
+		total += size
+	}
+	if len(parts) != state.Parts || total != state.Offset {
+		return nil, errs.Errorf("upload parts do not match the journal")
+	}
+	if err := state.save(opts.Journal); err != nil {
+		return nil, err
+	}
+
+	u := newMultipartUpload(proj, opts.Journal, state, opts)
+	p, err := newPendingPack(u, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.counter.N = state.Offset
+	p.z.SetOffset(state.Offset)
+	for i := range state.Entries {
+		e := &state.Entries[i]
+		if err := p.z.AppendEntry(e.header(), e.Offset, e.ContentOffset); err != nil {
+			return nil, err
+		}
+		p.reserveName(e.Name)
+		if p.dedup != nil && len(e.Digest) == sha256.Size {
+			var sum [sha256.Size]byte
+			copy(sum[:], e.Digest)
+			p.dedup.wrote(sum, i)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,353 @@
+package zipper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+)
+
+var errCrash = errors.New("crash")
+
+// callKey marks the context of the call a fakeMultipart call belongs to.
+type callKey struct{}
+
+// fakeMultipart keeps one multipart upload in memory.
+type fakeMultipart struct {
+	parts    map[uint32][]byte
+	object   []byte
+	custom   uplink.CustomMetadata
+	aborted  bool
+	contexts []string // the callKey of every call after beginUpload
+
+	// crashPart, if set, makes uploading that part fail, after storing it
+	// if landed is set.
+	crashPart uint32
+	landed    bool
+}
+
+func (m *fakeMultipart) record(ctx context.Context) {
+	call, _ := ctx.Value(callKey{}).(string)
+	m.contexts = append(m.contexts, call)
+}
+
+func (m *fakeMultipart) beginUpload(ctx context.Context, bucket, key string,
+	options *uplink.UploadOptions) (string, error) {
+	m.parts = make(map[uint32][]byte)
+	return "upload", nil
+}
+
+func (m *fakeMultipart) uploadPart(ctx context.Context, bucket, key, uploadID string, number uint32,
+	data io.Reader) error {
+	m.record(ctx)
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if number == m.crashPart {
+		if m.landed {
+			m.parts[number] = b
+		}
+		return errCrash
+	}
+	m.parts[number] = b
+	return nil
+}
+
+func (m *fakeMultipart) listParts(ctx context.Context, bucket, key, uploadID string) (map[uint32]int64, error) {
+	parts := make(map[uint32]int64)
+	for number, b := range m.parts {
+		parts[number] = int64(len(b))
+	}
+	return parts, nil
+}
+
+func (m *fakeMultipart) commitUpload(ctx context.Context, bucket, key, uploadID string,
+	custom uplink.CustomMetadata) (*uplink.Object, error) {
+	m.record(ctx)
+	numbers := make([]int, 0, len(m.parts))
+	for number := range m.parts {
+		numbers = append(numbers, int(number))
+	}
+	sort.Ints(numbers)
+	var object []byte
+	for i, number := range numbers {
+		if number != i+1 {
+			return nil, errs.Errorf("missing part %d", i+1)
+		}
+		object = append(object, m.parts[uint32(number)]...)
+	}
+	m.object, m.custom = object, custom
+	return &uplink.Object{Key: key, Custom: custom}, nil
+}
+
+func (m *fakeMultipart) abortUpload(ctx context.Context, bucket, key, uploadID string) error {
+	m.record(ctx)
+	m.aborted = true
+	return nil
+}
+
+func resumableOptions(journal string) *CreateOptions {
+	return &CreateOptions{Journal: journal, PartSize: 1000}
+}
+
+func createFakeResumable(t *testing.T, m *fakeMultipart, journal string) *PendingPack {
+	t.Helper()
+	opts := resumableOptions(journal)
+	u, err := createResumable(context.Background(), m, "bucket", "pack.zip", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPendingPack(u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// addEntries adds the stored entries first to last-1, each about 700 bytes
+// long, so that a part is uploaded before every other entry.
+func addEntries(ctx context.Context, p *PendingPack, first, last int) error {
+	for i := first; i < last; i++ {
+		w, err := p.Add(ctx, fmt.Sprintf("entry-%d.txt", i), &FileHeader{Compression: CompressionStore})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, strings.Repeat(fmt.Sprint(i), 650)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEntries(t *testing.T, data []byte, n int) {
+	t.Helper()
+	z := readZip(t, data)
+	if len(z.File) != n {
+		t.Fatalf("got %d entries, want %d", len(z.File), n)
+	}
+	for i, f := range z.File {
+		if f.Name != fmt.Sprintf("entry-%d.txt", i) {
+			t.Fatalf("entry %d is %q", i, f.Name)
+		}
+		if readZipFile(t, f) != strings.Repeat(fmt.Sprint(i), 650) {
+			t.Fatalf("%s: wrong content", f.Name)
+		}
+	}
+}
+
+func TestResumableUploadContexts(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "journal")
+	m := new(fakeMultipart)
+	p := createFakeResumable(t, m, journal)
+
+	add := context.WithValue(context.Background(), callKey{}, "add")
+	if err := addEntries(add, p, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(context.WithValue(context.Background(), callKey{}, "commit")); err != nil {
+		t.Fatal(err)
+	}
+	want := "[add commit commit]"
+	if got := fmt.Sprint(m.contexts); got != want {
+		t.Errorf("calls made with contexts %s, want %s", got, want)
+	}
+	checkEntries(t, m.object, 4)
+	if m.custom[directoryOffsetKey] == "" {
+		t.Error("metadata not committed")
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("journal not removed: %v", err)
+	}
+
+	p = createFakeResumable(t, m, journal)
+	if err := p.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.aborted {
+		t.Error("upload not aborted")
+	}
+}
+
+func TestJournalSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal")
+	j := &journal{
+		Version:  journalVersion,
+		Bucket:   "bucket",
+		Key:      "key",
+		UploadID: "upload",
+		Parts:    2,
+		Offset:   1234,
+		Entries: []journalEntry{
+			{Name: "a.txt", Method: 8, CRC32: 42, CompressedSize64: 10, UncompressedSize64: 20, Offset: 0, ContentOffset: 35, Digest: []byte{1, 2, 3}},
+			{Name: "b/", ExternalAttrs: 0x10, Offset: 45, ContentOffset: 78},
+		},
+		Done:        1,
+		PendingSize: 99,
+	}
+	if err := j.save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", j) {
+		t.Fatalf("got %+v, want %+v", got, j)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 1 {
+		t.Fatalf("left temporary files: %v", matches)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"torn":    string(data[:len(data)/2]),
+		"version": strings.Replace(string(data), `"version":1`, `"version":7`, 1),
+		"done":    strings.Replace(string(data), `"done":1`, `"done":3`, 1),
+	} {
+		bad := filepath.Join(dir, name)
+		if err := os.WriteFile(bad, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadJournal(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := loadJournal(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file", err)
+	}
+}
+
+func TestResumePack(t *testing.T) {
+	for _, landed := range []bool{false, true} {
+		t.Run(fmt.Sprint("landed=", landed), func(t *testing.T) {
+			ctx := context.Background()
+			journal := filepath.Join(t.TempDir(), "journal")
+			m := &fakeMultipart{crashPart: 3, landed: landed}
+			p := createFakeResumable(t, m, journal)
+
+			// Parts 1 and 2 hold two entries each, and uploading the third
+			// part fails, with or without it landing.
+			if err := addEntries(ctx, p, 0, 7); !errors.Is(err, errCrash) {
+				t.Fatalf("got %v, want the crash", err)
+			}
+			m.crashPart = 0
+			p, err := resumePack(ctx, m, resumableOptions(journal))
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := 4
+			if landed {
+				kept = 6
+			}
+			if got := len(p.Entries()); got != kept {
+				t.Fatalf("kept %d entries, want %d", got, kept)
+			}
+			if err := addEntries(ctx, p, kept, 9); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, m.object, 9)
+		})
+	}
+}
+
+func TestResumePackDedup(t *testing.T) {
+	ctx := context.Background()
+	opts := resumableOptions(filepath.Join(t.TempDir(), "journal"))
+	opts.Dedup = true
+	m := new(fakeMultipart)
+	u, err := createResumable(ctx, m, "bucket", "pack.zip", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPendingPack(u, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addEntries(ctx, p, 0, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave p behind, as if the process died, and resume.
+	p, err = resumePack(ctx, m, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Entries()) == 0 {
+		t.Fatal("no entries kept")
+	}
+	contentOffset := p.z.ContentOffset(0)
+	w, err := p.Add(ctx, "again.txt", &FileHeader{Compression: CompressionStore})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, strings.Repeat("0", 650)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if loc, ok := w.Locator(); !ok || loc.ContentOffset != contentOffset {
+		t.Errorf("content stored again at %d, want %d", loc.ContentOffset, contentOffset)
+	}
+	z := readZip(t, m.object)
+	last := z.File[len(z.File)-1]
+	if last.Name != "again.txt" || readZipFile(t, last) != strings.Repeat("0", 650) {
+		t.Errorf("got entry %q", last.Name)
+	}
+}
+
+func TestResumePackStaleJournal(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name   string
+		change func(m *fakeMultipart)
+	}{
+		{"missing part", func(m *fakeMultipart) { delete(m.parts, 2) }},
+		{"resized part", func(m *fakeMultipart) { m.parts[1] = m.parts[1][:10] }},
+		{"unexpected part", func(m *fakeMultipart) { m.parts[5] = []byte("later") }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			journal := filepath.Join(t.TempDir(), "journal")
+			m := new(fakeMultipart)
+			p := createFakeResumable(t, m, journal)
+			if err := addEntries(ctx, p, 0, 5); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.parts) != 2 {
+				t.Fatalf("uploaded %d parts, want 2", len(m.parts))
+			}
+			test.change(m)
+			if _, err := resumePack(ctx, m, resumableOptions(journal)); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	journal := filepath.Join(t.TempDir(), "journal")
+	if err := os.WriteFile(journal, []byte(`{"version":1,"parts":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumePack(ctx, new(fakeMultipart), resumableOptions(journal)); err == nil {
+		t.Fatal("resumed from a torn journal")
+	}
+	if _, err := createResumable(ctx, new(fakeMultipart), "bucket", "key", resumableOptions(journal)); err == nil {
+		t.Fatal("started a second upload with the same journal")
+	}
+}
@@ -0,0 +1,211 @@
+package zipper
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// EditOp is the kind of change a PackEdit makes.
+type EditOp int
+
+const (
+	// EditAdd adds a new entry, after all existing ones.
+	EditAdd EditOp = iota + 1
+
+	// EditReplace replaces the content of an entry, keeping its place.
+	EditReplace
+
+	// EditDelete removes an entry.
+	EditDelete
+
+	// EditRename changes the name of an entry, keeping its content.
+	EditRename
+)
+
+// PackEdit is a change made by RewritePack. Names are entry names as they
+// appear in the pack, so directories end in a slash, and renaming a
+// directory entry does not rename the entries below it.
+type PackEdit struct {
+	Op   EditOp
+	Name string
+
+	// NewName is the name an entry is renamed to.
+	NewName string
+
+	// Header and Content describe added or replaced entries. A nil Header
+	// keeps the attributes of a replaced entry, and a nil Content adds an
+	// empty entry.
+	Header  *FileHeader
+	Content io.Reader
+}
+
+// RewritePack creates a new pack at dstBucket/dstKey holding the entries of
+// the pack at srcBucket/srcKey with edits applied. Entries that are not
+// edited are copied without being recompressed, and the archive comment,
+// custom metadata and expiration of the source pack are carried over. The
+// new pack can replace the source pack, since it is only committed once the
+// source has been read completely.
+func RewritePack(ctx context.Context, proj *uplink.Project, srcBucket, srcKey, dstBucket, dstKey string,
+	edits []PackEdit) (err error) {
+	plan, err := planEdits(edits)
+	if err != nil {
+		return err
+	}
+
+	src, err := OpenPack(ctx, proj, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, src.Close()) }()
+
+	return plan.rewrite(ctx, src, func() (*PendingPack, error) {
+		return CreatePack(ctx, proj, dstBucket, dstKey, &uplink.UploadOptions{
+			Expires: src.info.System.Expires,
+		})
+	})
+}
+
+// editPlan is a validated set of edits.
+type editPlan struct {
+	edits   []PackEdit
+	changes map[string]*PackEdit // replaces, deletes and renames by name
+	adds    []*PackEdit
+}
+
+func planEdits(edits []PackEdit) (*editPlan, error) {
+	plan := &editPlan{edits: edits, changes: make(map[string]*PackEdit)}
+	for i := range edits {
+		e := &edits[i]
+		switch e.Op {
+		case EditAdd:
+			plan.adds = append(plan.adds, e)
+		case EditReplace, EditDelete, EditRename:
+			if e.Op == EditRename && e.NewName == "" {
+				return nil, errs.Errorf("%q: rename without a new name", e.Name)
+			}
+			if _, dup := plan.changes[e.Name]; dup {
+				return nil, errs.Errorf("%q: more than one edit", e.Name)
+			}
+			plan.changes[e.Name] = e
+		default:
+			return nil, errs.Errorf("%q: unknown edit operation %d", e.Name, e.Op)
+		}
+	}
+	return plan, nil
+}
+
+// rewrite writes src with the edits applied to the pack returned by
+// create, which is only called once the edits are known to apply.
+func (plan *editPlan) rewrite(ctx context.Context, src *Pack, create func() (*PendingPack, error)) error {
+	changes := plan.changes
+
+	// Work out the resulting names first, so conflicts are found before
+	// anything is uploaded.
+	names := make(map[string]bool)
+	seen := make(map[string]bool)
+	for i, n := 0, src.zr.NumFiles(); i < n; i++ {
+		name := src.zr.FileAt(i).Name
+		if e := changes[name]; e != nil {
+			seen[name] = true
+			if e.Op != EditReplace {
+				continue
+			}
+		}
+		names[name] = true
+	}
+	for _, e := range plan.edits {
+		switch e.Op {
+		case EditReplace, EditDelete, EditRename:
+			if !seen[e.Name] {
+				return &fs.PathError{Op: "rewrite", Path: e.Name, Err: fs.ErrNotExist}
+			}
+		}
+		var name string
+		switch e.Op {
+		case EditAdd:
+			name = e.Name
+		case EditRename:
+			name = e.NewName
+		default:
+			continue
+		}
+		if names[name] {
+			return &fs.PathError{Op: "rewrite", Path: name, Err: fs.ErrExist}
+		}
+		names[name] = true
+	}
+
+	dst, err := create()
+	if err != nil {
+		return err
+	}
+	for i, n := 0, src.zr.NumFiles(); i < n; i++ {
+		f := src.zr.FileAt(i)
+		e := changes[f.Name]
+		switch {
+		case e == nil:
+			err = dst.CopyFrom(ctx, f)
+		case e.Op == EditDelete:
+		case e.Op == EditRename:
+			err = copyRenamed(ctx, dst, f, e.NewName)
+		case e.Op == EditReplace:
+			header := e.Header
+			if header == nil {
+				h := fileHeader(f)
+				header = &h
+			}
+			err = addEdited(ctx, dst, f.Name, header, e.Content)
+		}
+		if err != nil {
+			return errs.Combine(err, dst.Abort())
+		}
+	}
+	for _, e := range plan.adds {
+		if err := addEdited(ctx, dst, e.Name, e.Header, e.Content); err != nil {
+			return errs.Combine(err, dst.Abort())
+		}
+	}
+
+	if comment := src.Comment(); comment != "" {
+		if err := dst.SetComment(comment); err != nil {
+			return errs.Combine(err, dst.Abort())
+		}
+	}
+	if src.info != nil && src.info.Custom != nil {
+		custom := src.info.Custom.Clone()
+		for _, key := range metadataKeys {
+			delete(custom, key)
+		}
+		dst.SetCustomMetadata(custom)
+	}
+	return dst.Commit(ctx)
+}
+
+func copyRenamed(ctx context.Context, p *PendingPack, f *zipread.File, name string) (err error) {
+	rc, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	defer func() { err = errs.Combine(err, rc.Close()) }()
+	header := f.FileHeader
+	zipread.SetHeaderName(&header, name)
+	return p.AddRaw(ctx, &header, rc)
+}
+
+func addEdited(ctx context.Context, p *PendingPack, name string, header *FileHeader, content io.Reader) error {
+	if strings.HasSuffix(name, "/") {
+		return p.AddDir(ctx, name, header)
+	}
+	if content == nil {
+		content = strings.NewReader("")
+	}
+	_, err := p.addContent(ctx, name, header, content)
+	return err
+}
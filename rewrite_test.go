@@ -0,0 +1,217 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+// storedPack is a pack object that can be replaced, and that fails reads
+// made after it was.
+type storedPack struct {
+	data     []byte
+	custom   uplink.CustomMetadata
+	replaced bool
+}
+
+func (s *storedPack) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if s.replaced {
+		return nil, errors.New("read from a replaced pack")
+	}
+	return zipread.SourceFromReaderAt(bytes.NewReader(s.data), int64(len(s.data))).Range(ctx, offset, length)
+}
+
+func (s *storedPack) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	if s.replaced {
+		return nil, 0, errors.New("read from a replaced pack")
+	}
+	return zipread.SourceFromReaderAt(bytes.NewReader(s.data), int64(len(s.data))).RangeFromEnd(ctx, length)
+}
+
+// open opens the stored pack as RewritePack does.
+func (s *storedPack) open(t *testing.T) *Pack {
+	t.Helper()
+	pack, err := openSource(context.Background(), s, int64(len(s.data)), -1, &OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack.info = &uplink.Object{Custom: s.custom}
+	return pack
+}
+
+// storeDestination replaces a storedPack when committed.
+type storeDestination struct {
+	MemoryDestination
+	store *storedPack
+}
+
+func (d *storeDestination) Commit(ctx context.Context) error {
+	if err := d.MemoryDestination.Commit(ctx); err != nil {
+		return err
+	}
+	d.store.data, d.store.custom = d.Bytes(), d.CustomMetadata()
+	d.store.replaced = true
+	return nil
+}
+
+func newStoredPack(t *testing.T) *storedPack {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"keep.txt", "delete.txt", "replace.txt", "rename.txt", "ünïcödé.txt"} {
+		w, err := p.Add(ctx, name, &FileHeader{Modified: modified, Mode: 0640, Comment: "was " + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, strings.Repeat(name, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddDir(ctx, "dir", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetComment("pack comment"); err != nil {
+		t.Fatal(err)
+	}
+	p.SetCustomMetadata(uplink.CustomMetadata{"owner": "someone"})
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return &storedPack{data: u.Bytes(), custom: u.CustomMetadata()}
+}
+
+func TestRewritePack(t *testing.T) {
+	ctx := context.Background()
+	store := newStoredPack(t)
+	plan, err := planEdits([]PackEdit{
+		{Op: EditDelete, Name: "delete.txt"},
+		{Op: EditReplace, Name: "replace.txt", Content: strings.NewReader("replaced")},
+		{Op: EditRename, Name: "rename.txt", NewName: "rénamed.txt"},
+		{Op: EditRename, Name: "ünïcödé.txt", NewName: "ascii.txt"},
+		{Op: EditAdd, Name: "added.txt", Header: &FileHeader{Mode: 0600}, Content: strings.NewReader("added")},
+		{Op: EditAdd, Name: "added-dir/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the pack in place: every read of the source has to happen
+	// before the new pack replaces it.
+	src := store.open(t)
+	err = plan.rewrite(ctx, src, func() (*PendingPack, error) {
+		return CreatePackTo(ctx, &storeDestination{store: store}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = src.Close()
+	if !store.replaced {
+		t.Fatal("pack was not replaced")
+	}
+	store.replaced = false
+	pack := store.open(t)
+	defer func() { _ = pack.Close() }()
+
+	want := "[keep.txt replace.txt rénamed.txt ascii.txt dir/ added.txt added-dir/]"
+	if got := strings.Join(pack.ListAll(), " "); "["+got+"]" != want {
+		t.Fatalf("got entries [%s], want %s", got, want)
+	}
+	for name, content := range map[string]string{
+		"keep.txt":    strings.Repeat("keep.txt", 100),
+		"replace.txt": "replaced",
+		"rénamed.txt": strings.Repeat("rename.txt", 100),
+		"ascii.txt":   strings.Repeat("ünïcödé.txt", 100),
+		"added.txt":   "added",
+	} {
+		if got := readEntry(t, pack, name); got != content {
+			t.Errorf("%s: got %.20q", name, got)
+		}
+	}
+
+	// Replacing keeps the attributes, renaming keeps everything but the
+	// name, with the UTF-8 flag following the new name.
+	for name, wantComment := range map[string]string{
+		"replace.txt": "was replace.txt",
+		"rénamed.txt": "was rename.txt",
+		"ascii.txt":   "was ünïcödé.txt",
+	} {
+		fi, err := pack.FileInfo(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Comment != wantComment || fi.Mode != 0640 {
+			t.Errorf("%s: got comment %q mode %v", name, fi.Comment, fi.Mode)
+		}
+	}
+	for i, n := 0, pack.zr.NumFiles(); i < n; i++ {
+		f := pack.zr.FileAt(i)
+		needsUTF8 := f.Name == "rénamed.txt" || f.Name == "ascii.txt"
+		if got := f.Flags&0x800 != 0; got != needsUTF8 {
+			t.Errorf("%s: UTF-8 flag %v, want %v", f.Name, got, needsUTF8)
+		}
+	}
+
+	if pack.Comment() != "pack comment" || store.custom["owner"] != "someone" {
+		t.Errorf("got comment %q and metadata %v", pack.Comment(), store.custom)
+	}
+	if m := parseMetadata(store.custom); m.entries != 7 {
+		t.Errorf("pack metadata was not rewritten: %+v", m)
+	}
+}
+
+func TestRewritePackConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := newStoredPack(t)
+	for _, test := range []struct {
+		edits []PackEdit
+		want  error
+	}{
+		{[]PackEdit{{Op: EditDelete, Name: "missing.txt"}}, fs.ErrNotExist},
+		{[]PackEdit{{Op: EditRename, Name: "keep.txt", NewName: "delete.txt"}}, fs.ErrExist},
+		{[]PackEdit{{Op: EditAdd, Name: "keep.txt"}}, fs.ErrExist},
+		{[]PackEdit{
+			{Op: EditDelete, Name: "delete.txt"},
+			{Op: EditRename, Name: "keep.txt", NewName: "delete.txt"},
+		}, nil},
+	} {
+		plan, err := planEdits(test.edits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := false
+		src := store.open(t)
+		err = plan.rewrite(ctx, src, func() (*PendingPack, error) {
+			created = true
+			return CreatePackTo(ctx, new(MemoryDestination), nil)
+		})
+		_ = src.Close()
+		if !errors.Is(err, test.want) && !(test.want == nil && err == nil) {
+			t.Errorf("%+v: got %v, want %v", test.edits, err, test.want)
+		}
+		if created != (test.want == nil) {
+			t.Errorf("%+v: pack created %v", test.edits, created)
+		}
+	}
+
+	for _, edits := range [][]PackEdit{
+		{{Op: EditRename, Name: "keep.txt"}},
+		{{Op: EditDelete, Name: "keep.txt"}, {Op: EditReplace, Name: "keep.txt"}},
+		{{Op: 0, Name: "keep.txt"}},
+	} {
+		if _, err := planEdits(edits); err == nil {
+			t.Errorf("%+v: expected an error", edits)
+		}
+	}
+}
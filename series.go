@@ -0,0 +1,199 @@
+package zipper
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+)
+
+const (
+	defaultSeriesMaxSize    = 64 << 20
+	defaultSeriesMaxEntries = 10000
+)
+
+// SeriesOptions configures a PackSeries.
+type SeriesOptions struct {
+	// KeyTemplate is the fmt format of the packs' keys, given the pack's
+	// number, counting from zero, such as "ingest/pack-%05d.zip".
+	KeyTemplate string
+
+	// MaxSize and MaxEntries are the thresholds at which the next entry
+	// goes into a new pack. Since a pack is only rolled over between
+	// entries, it can exceed MaxSize by up to one entry. Zero uses 64 MiB
+	// and 10000 entries.
+	MaxSize    int64
+	MaxEntries int
+
+	// Create configures every pack in the series.
+	Create *CreateOptions
+
+	// Destination, if set, returns where the pack with the given key is
+	// written, such as a FileDestination, instead of uploading it to the
+	// series' bucket. The packs are then created with CreatePackTo.
+	Destination func(ctx context.Context, key string) (Destination, error)
+}
+
+// SeriesEntry records where an entry written by a PackSeries ended up.
+type SeriesEntry struct {
+	Name string
+	Key  string
+	EntryLocator
+}
+
+// PackSeries writes entries to a series of packs, starting a new pack
+// whenever the current one reaches a size or entry count threshold.
+type PackSeries struct {
+	proj   *uplink.Project
+	bucket string
+	opts   SeriesOptions
+
+	cur     *PendingPack
+	key     string
+	next    int
+	entries []seriesPending
+	written []SeriesEntry
+}
+
+type seriesPending struct {
+	name string
+	fw   *FileWriter
+}
+
+// CreatePackSeries starts a series of packs in bucket. No pack is created
+// until the first entry is added. proj and bucket are not used if
+// opts.Destination is set.
+func CreatePackSeries(ctx context.Context, proj *uplink.Project, bucket string, opts SeriesOptions) (*PackSeries, error) {
+	if opts.KeyTemplate == "" {
+		return nil, errs.Errorf("missing key template")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultSeriesMaxSize
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultSeriesMaxEntries
+	}
+	return &PackSeries{
+		proj:   proj,
+		bucket: bucket,
+		opts:   opts,
+	}, nil
+}
+
+// Add adds an entry to the current pack, first rolling over to a new pack
+// if the current one is full. See PendingPack.Add.
+func (s *PackSeries) Add(ctx context.Context, name string, options *FileHeader) (*FileWriter, error) {
+	if s.cur != nil {
+		full, err := s.full()
+		if err != nil {
+			return nil, err
+		}
+		if full {
+			if err := s.commitCurrent(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.cur == nil {
+		s.key = fmt.Sprintf(s.opts.KeyTemplate, s.next)
+		p, err := s.create(ctx, s.key)
+		if err != nil {
+			return nil, err
+		}
+		s.cur = p
+		s.next++
+	}
+	fw, err := s.cur.Add(ctx, name, options)
+	if err != nil {
+		return nil, err
+	}
+	// Record the name as stored, which may have been normalized.
+	s.entries = append(s.entries, seriesPending{name: fw.header.Name, fw: fw})
+	return fw, nil
+}
+
+// create creates the pack with the given key.
+func (s *PackSeries) create(ctx context.Context, key string) (*PendingPack, error) {
+	if s.opts.Destination == nil {
+		return CreatePackWithOptions(ctx, s.proj, s.bucket, key, s.opts.Create)
+	}
+	dst, err := s.opts.Destination(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return CreatePackTo(ctx, dst, s.opts.Create)
+}
+
+// full finishes the last entry of the current pack and reports whether the
+// pack has reached a threshold. Entries still being compressed are only
+// waited for once they could take the pack to MaxSize, so that the pack is
+// rolled over on the size of what it actually holds.
+func (s *PackSeries) full() (bool, error) {
+	p := s.cur
+	if err := p.finish(p.cur); err != nil {
+		return false, err
+	}
+	if len(s.entries) >= s.opts.MaxEntries {
+		return true, nil
+	}
+	// Count what the ZIP writer still buffers.
+	if err := p.z.Flush(); err != nil {
+		return false, err
+	}
+	if p.par != nil && p.counter.N+p.par.queuedSize() >= s.opts.MaxSize {
+		if err := p.drain(); err != nil {
+			return false, err
+		}
+		if err := p.z.Flush(); err != nil {
+			return false, err
+		}
+	}
+	return p.counter.N >= s.opts.MaxSize, nil
+}
+
+func (s *PackSeries) commitCurrent(ctx context.Context) error {
+	p := s.cur
+	s.cur = nil
+	if err := p.Commit(ctx); err != nil {
+		return err
+	}
+	for _, e := range s.entries {
+		loc, ok := e.fw.Locator()
+		if !ok {
+			return errs.Errorf("%q: entry was not written", e.name)
+		}
+		s.written = append(s.written, SeriesEntry{Name: e.name, Key: s.key, EntryLocator: loc})
+	}
+	s.entries = nil
+	return nil
+}
+
+// Commit commits the last pack and returns where every entry was written,
+// in the order they were added.
+func (s *PackSeries) Commit(ctx context.Context) ([]SeriesEntry, error) {
+	if s.cur != nil {
+		if err := s.commitCurrent(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s.written, nil
+}
+
+// Abort aborts the pack being written. Packs that were already full have
+// been committed and are left alone; Written lists their entries.
+func (s *PackSeries) Abort() error {
+	if s.cur == nil {
+		return nil
+	}
+	p := s.cur
+	s.cur, s.entries = nil, nil
+	return p.Abort()
+}
+
+// Written returns where the entries of the packs committed so far were
+// written.
+func (s *PackSeries) Written() []SeriesEntry {
+	return s.written
+}
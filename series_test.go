@@ -0,0 +1,147 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"storj.io/zipper/zipread"
+)
+
+// buildSeries adds n entries of about 700 bytes to a series written to
+// memory, returning the packs by key.
+func buildSeries(t *testing.T, n int, opts SeriesOptions) (map[string]*MemoryDestination, []SeriesEntry) {
+	ctx := context.Background()
+	packs := make(map[string]*MemoryDestination)
+	opts.KeyTemplate = "pack-%d.zip"
+	opts.Destination = func(ctx context.Context, key string) (Destination, error) {
+		packs[key] = new(MemoryDestination)
+		return packs[key], nil
+	}
+	s, err := CreatePackSeries(ctx, nil, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		w, err := s.Add(ctx, fmt.Sprintf("entry-%d.txt", i), &FileHeader{Compression: CompressionStore})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, strings.Repeat(fmt.Sprint(i), 650)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != n {
+		t.Fatalf("got %d entries, want %d", len(written), n)
+	}
+	return packs, written
+}
+
+// seriesSplit describes which pack every entry went to.
+func seriesSplit(written []SeriesEntry) string {
+	var keys []string
+	for _, e := range written {
+		keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(e.Key, "pack-"), ".zip"))
+	}
+	return strings.Join(keys, "")
+}
+
+func TestPackSeriesThresholds(t *testing.T) {
+	for _, concurrency := range []int{0, 4} {
+		_, written := buildSeries(t, 7, SeriesOptions{
+			MaxEntries: 3,
+			Create:     &CreateOptions{Concurrency: concurrency},
+		})
+		if got := seriesSplit(written); got != "0001112" {
+			t.Errorf("concurrency %d: split by count as %s", concurrency, got)
+		}
+
+		// Every entry takes about 750 bytes, so packs get to 2000 bytes
+		// with their third entry, even when those are still queued for
+		// compression.
+		packs, written := buildSeries(t, 8, SeriesOptions{
+			MaxSize: 2000,
+			Create:  &CreateOptions{Concurrency: concurrency},
+		})
+		if got := seriesSplit(written); got != "00011122" {
+			t.Errorf("concurrency %d: split by size as %s", concurrency, got)
+		}
+		for key, pack := range packs {
+			if dirOffset := parseMetadata(pack.CustomMetadata()).dirOffset; dirOffset > 3000 {
+				t.Errorf("concurrency %d: %s holds %d bytes of entries", concurrency, key, dirOffset)
+			}
+		}
+	}
+}
+
+func TestPackSeriesManifest(t *testing.T) {
+	packs, written := buildSeries(t, 10, SeriesOptions{
+		MaxEntries: 4,
+		Create:     &CreateOptions{Concurrency: 2},
+	})
+	if len(packs) != 3 {
+		t.Fatalf("wrote %d packs, want 3", len(packs))
+	}
+	for i, e := range written {
+		if e.Name != fmt.Sprintf("entry-%d.txt", i) {
+			t.Fatalf("entry %d is %q", i, e.Name)
+		}
+		data := packs[e.Key].Bytes()
+		section := io.NewSectionReader(bytes.NewReader(data), e.ContentOffset, e.CompressedSize)
+		rc, err := zipread.NewEntryReader(io.NopCloser(section), e.Method, e.CRC32, uint64(e.Size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("%s: %v", e.Name, err)
+		}
+		if string(content) != strings.Repeat(fmt.Sprint(i), 650) {
+			t.Errorf("%s: wrong content at offset %d of %s", e.Name, e.ContentOffset, e.Key)
+		}
+		_ = rc.Close()
+	}
+	for key, pack := range packs {
+		if !pack.Committed() {
+			t.Errorf("%s was not committed", key)
+		}
+	}
+}
+
+func TestPackSeriesNormalizedNames(t *testing.T) {
+	ctx := context.Background()
+	packs := make(map[string]*MemoryDestination)
+	s, err := CreatePackSeries(ctx, nil, "", SeriesOptions{
+		KeyTemplate: "pack-%d.zip",
+		Create:      &CreateOptions{NormalizeNames: true},
+		Destination: func(ctx context.Context, key string) (Destination, error) {
+			packs[key] = new(MemoryDestination)
+			return packs[key], nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`\win\a.txt`, "/abs/./b.txt"} {
+		if _, err := s.Add(ctx, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := s.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := readZip(t, packs["pack-0.zip"].Bytes())
+	for i, e := range written {
+		if e.Name != z.File[i].Name {
+			t.Errorf("entry %d recorded as %q, stored as %q", i, e.Name, z.File[i].Name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package zipper
+
+import (
+	"context"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/uplink"
+)
+
+// PackStats are facts about a pack as a whole.
+type PackStats struct {
+	// Entries is the number of entries, including directories, and
+	// UncompressedSize is the sum of their sizes.
+	Entries          int
+	UncompressedSize int64
+
+	// Size is the size of the pack, and DirectoryOffset and DirectorySize
+	// describe its central directory. They are zero if unknown.
+	Size            int64
+	DirectoryOffset int64
+	DirectorySize   int64
+
+	// WriterVersion is the version of the writer that made the pack, as
+	// recorded in its metadata: 1 for writers that record stats, 0 for
+	// writers that only recorded the directory offset, and -1 if the pack
+	// has no pack metadata at all.
+	WriterVersion int
+}
+
+// setMetadata records the pack metadata of p in custom, once all entries
+// are finished.
+func (p *PendingPack) setMetadata(custom uplink.CustomMetadata) {
+	m := packMetadata{
+		dirOffset: p.dirOff,
+		dirSize:   p.z.DirectorySize(),
+		entries:   int64(p.z.NumEntries()),
+	}
+	for i, n := 0, p.z.NumEntries(); i < n; i++ {
+		fh, _ := p.z.Entry(i)
+		m.uncompressedSize += int64(fh.UncompressedSize64)
+	}
+	m.set(custom)
+}
+
+// statsFromObject returns the stats recorded in the metadata of info, if
+// the pack's writer recorded them.
+func statsFromObject(info *uplink.Object) (*PackStats, bool) {
+	m := parseMetadata(info.Custom)
+	if !m.hasStats {
+		return nil, false
+	}
+	return m.stats(info.System.ContentLength), true
+}
+
+func (m *packMetadata) stats(size int64) *PackStats {
+	return &PackStats{
+		Entries:          int(m.entries),
+		UncompressedSize: m.uncompressedSize,
+		Size:             size,
+		DirectoryOffset:  m.dirOffset,
+		DirectorySize:    m.dirSize,
+		WriterVersion:    m.version,
+	}
+}
+
+// StatPack returns the stats of the pack at bucket/key from its metadata,
+// with a single StatObject call. Packs whose writer did not record stats
+// have to be opened instead; see Pack.Stats.
+func StatPack(ctx context.Context, proj *uplink.Project, bucket, key string) (*PackStats, error) {
+	info, err := proj.StatObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	stats, ok := statsFromObject(info)
+	if !ok {
+		return nil, errs.Errorf("pack %q has no recorded stats", key)
+	}
+	return stats, nil
+}
+
+// Stats returns the stats of the pack. They come from the pack's metadata
+// if it was stat'ed when opened and has them, and are otherwise counted
+// from the central directory.
+func (p *Pack) Stats() *PackStats {
+	if p.info != nil {
+		if stats, ok := statsFromObject(p.info); ok {
+			return stats
+		}
+	}
+	m := p.directoryMetadata()
+	if p.info != nil {
+		m.version = parseMetadata(p.info.Custom).version
+	}
+	return m.stats(p.size)
+}
+
+// Comment returns the archive comment of the pack, without the trailer
+// packs add to it.
+func (p *Pack) Comment() string {
+	comment, _, _, _ := splitTrailer(p.zr.Comment)
+	return comment
+}
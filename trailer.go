@@ -0,0 +1,74 @@
+package zipper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs/v2"
+
+	"storj.io/zipper/zipread"
+)
+
+// Packs end their archive comment with a trailer holding the offset and
+// size of the central directory, so that they can be opened efficiently
+// even if their custom metadata is lost, such as when they are copied with
+// tools that drop it. The trailer is the magic string followed by the
+// offset and the size as 16 hexadecimal digits each.
+const (
+	trailerMagic = "\nzipper-directory:"
+	trailerLen   = len(trailerMagic) + 2*16
+
+	// maxCommentLen is how long a comment can be next to the trailer.
+	maxCommentLen = 1<<16 - 1 - trailerLen
+)
+
+// appendTrailer appends the trailer describing a central directory at
+// offset of the given size to comment.
+func appendTrailer(comment string, offset, size int64) string {
+	return fmt.Sprintf("%s%s%016x%016x", comment, trailerMagic, offset, size)
+}
+
+// splitTrailer returns comment without its trailer, and the directory
+// offset and size from the trailer, if any.
+func splitTrailer(comment string) (rest string, offset, size int64, ok bool) {
+	if len(comment) < trailerLen {
+		return comment, 0, 0, false
+	}
+	rest, trailer := comment[:len(comment)-trailerLen], comment[len(comment)-trailerLen:]
+	if !strings.HasPrefix(trailer, trailerMagic) {
+		return comment, 0, 0, false
+	}
+	numbers := trailer[len(trailerMagic):]
+	offset, err1 := strconv.ParseInt(numbers[:16], 16, 64)
+	size, err2 := strconv.ParseInt(numbers[16:], 16, 64)
+	if err1 != nil || err2 != nil || offset < 0 || size < 0 {
+		return comment, 0, 0, false
+	}
+	return rest, offset, size, true
+}
+
+// readTrailer returns the directory offset from the trailer at the end of
+// source, if any. source is expected to be prefetched already. A trailer
+// describing a directory that does not fit in source is ignored.
+func readTrailer(ctx context.Context, source zipread.Source) (offset int64, ok bool, err error) {
+	rc, sourceSize, err := source.RangeFromEnd(ctx, int64(trailerLen))
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() { err = errs.Combine(err, rc.Close()) }()
+	buf := make([]byte, trailerLen)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	_, offset, size, ok := splitTrailer(string(buf))
+	if !ok || offset+size > sourceSize {
+		return 0, false, nil
+	}
+	return offset, true, nil
+}
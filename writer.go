@@ -1,16 +1,18 @@
 package zipper
 
 import (
-	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"hash"
 	"io"
-	"strconv"
+	"io/fs"
 	"strings"
 	"time"
 
 	"github.com/zeebo/errs/v2"
 
 	"storj.io/uplink"
+	"storj.io/zipper/zipread"
 )
 
 const (
@@ -18,30 +20,251 @@ const (
 	contentTypeZip = "application/zip"
 )
 
+// checkpointer is implemented by destinations that record their progress
+// between entries, when everything created in z has been written. d is
+// set if the pack deduplicates contents.
+type checkpointer interface {
+	checkpoint(ctx context.Context, z *zipread.Writer, d *dedup) error
+}
+
 type PendingPack struct {
-	u       *uplink.Upload
-	z       *zip.Writer
+	u       Destination
+	z       *zipread.Writer
 	counter *countingWriter
 	meta    uplink.CustomMetadata
+	metaErr error // set if meta does not fit in the archive comment
+	comment string
+	cur     *FileWriter         // the entry being written, if any
+	dirOff  int64               // set on Commit
+	names   map[string]nameKind // entry names without trailing slashes
+	last    string              // the last entry name, for deterministic packs
+
+	autoSampleSize int
+	autoMinSavings float64
+	par            *parallel // set when compressing concurrently
+	deterministic  bool
+	modTime        time.Time
+	digests        bool
+	normalizeNames bool
+	dedup          *dedup // set when deduplicating contents
+}
+
+// CreateOptions configures CreatePackWithOptions.
+type CreateOptions struct {
+	// Upload is passed on to UploadObject. It is not used by CreatePackTo.
+	Upload *uplink.UploadOptions
+
+	// AutoSampleSize is how much of an entry using CompressionAuto is
+	// buffered to decide how to store it. Zero uses 64 KiB.
+	AutoSampleSize int
+
+	// AutoMinSavings is the fraction of the sample that deflate has to
+	// save for an entry using CompressionAuto to be deflated. Zero uses 0.1.
+	AutoMinSavings float64
+
+	// CompressionLevel is the flate level used for deflated entries, from
+	// flate.HuffmanOnly to flate.BestCompression. Zero uses the default
+	// level; entries that should not be compressed use CompressionStore.
+	CompressionLevel int
+
+	// Concurrency, if greater than one, is how many entries are compressed
+	// at the same time. Entries are then buffered as they are written and
+	// compressed in the background, but still appear in the pack in the
+	// order they were added.
+	Concurrency int
+
+	// MemoryBudget limits the memory used for buffering entries when
+	// Concurrency is set. Entries that do not fit are buffered in
+	// temporary files in TempDir instead. Zero uses 64 MiB.
+	MemoryBudget int64
+	TempDir      string
+
+	// Deterministic makes the pack depend only on the names and contents
+	// of its entries, so that packing the same inputs twice produces
+	// identical bytes. Entries have to be added in sorted order, comparing
+	// names one path element at a time, which is the order AddFS adds them
+	// in; other names are rejected with ErrNameOrder. Modification times
+	// are all set to ModTime, modes are normalized, and owners and other
+	// timestamps are dropped, including from entries added with AddRaw
+	// and CopyFrom.
+	// A zero ModTime uses SOURCE_DATE_EPOCH from the environment if set,
+	// and 1980-01-01 otherwise. Only the MS-DOS timestamp is stored, so
+	// ModTime is rounded down to an even second.
+	Deterministic bool
+	ModTime       time.Time
+
+	// Digests records the SHA-256 of the content of every entry added with
+	// Add in the pack's central directory. Readers can verify it and look
+	// entries up by it; see OpenOptions.VerifyDigests and Pack.LookupDigest.
+	Digests bool
+
+	// Journal, if set, makes the upload resumable. The pack is uploaded
+	// in parts of at least PartSize bytes, cut between entries, and the
+	// progress is saved to the file Journal after every part, so that
+	// ResumePack can continue the upload if the process dies. Zero
+	// PartSize uses 64 MiB. Parts are buffered like concurrently
+	// compressed entries; see MemoryBudget. Journal is not supported by
+	// CreatePackTo.
+	Journal  string
+	PartSize int64
+
+	// NormalizeNames makes Add, AddDir and AddRaw clean up entry names
+	// instead of rejecting those that are not valid io/fs paths:
+	// backslashes become slashes, and leading slashes, "." elements and
+	// ".." elements that would leave the pack are dropped. Names that are
+	// still invalid, such as empty ones, are rejected with ErrInvalidName.
+	NormalizeNames bool
+
+	// Dedup stores the content of entries added with Add only once: an
+	// entry whose content is the same as that of an earlier entry gets a
+	// central directory record pointing at the earlier entry's data, and
+	// is stored with the same method. Since an entry's content has to be
+	// hashed before anything is written for it, Dedup always buffers
+	// entries as with Concurrency, even if Concurrency is at most one,
+	// in which case they are compressed by a single background worker;
+	// MemoryBudget and TempDir apply.
+	//
+	// Entries sharing their data are valid ZIP, and are read by this
+	// package and Go's archive/zip, but Info-ZIP unzip 6.0 with the fix for
+	// CVE-2019-13232 rejects them as overlapping, as do other tools that
+	// guard against zip bombs that way. Do not use Dedup for packs that
+	// have to be extracted with them.
+	Dedup bool
 }
 
 func CreatePack(ctx context.Context, proj *uplink.Project, bucket, key string,
 	options *uplink.UploadOptions) (*PendingPack, error) {
-	u, err := proj.UploadObject(ctx, bucket, key, options)
+	return CreatePackWithOptions(ctx, proj, bucket, key, &CreateOptions{Upload: options})
+}
+
+// CreatePackWithOptions is like CreatePack, but allows configuring how
+// the pack is written.
+func CreatePackWithOptions(ctx context.Context, proj *uplink.Project, bucket, key string,
+	opts *CreateOptions) (*PendingPack, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	var u Destination
+	if opts.Journal != "" {
+		mu, err := createResumable(ctx, uplinkMultipart{proj: proj}, bucket, key, opts)
+		if err != nil {
+			return nil, err
+		}
+		u = mu
+	} else {
+		uu, err := NewUplinkDestination(ctx, proj, bucket, key, opts.Upload)
+		if err != nil {
+			return nil, err
+		}
+		u = uu
+	}
+	p, err := newPendingPack(u, opts)
 	if err != nil {
-		return nil, err
+		return nil, errs.Combine(err, u.Abort(ctx))
+	}
+	return p, nil
+}
+
+// CreatePackTo is like CreatePackWithOptions, but writes the pack to dst,
+// such as a FileDestination or a MemoryDestination. dst is aborted if the
+// pack cannot be created.
+func CreatePackTo(ctx context.Context, dst Destination, opts *CreateOptions) (*PendingPack, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	if opts.Journal != "" {
+		return nil, errs.Combine(errs.Errorf("journals need an uplink destination"), dst.Abort(ctx))
+	}
+	p, err := newPendingPack(dst, opts)
+	if err != nil {
+		return nil, errs.Combine(err, dst.Abort(ctx))
+	}
+	return p, nil
+}
+
+func newPendingPack(u Destination, opts *CreateOptions) (*PendingPack, error) {
+	var deflate zipread.Compressor
+	if opts.CompressionLevel != 0 {
+		var err error
+		deflate, err = zipread.DeflateCompressor(opts.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	counter := &countingWriter{w: u}
 
-	return &PendingPack{
-		u:       u,
-		z:       zip.NewWriter(counter),
-		counter: counter,
-	}, nil
+	p := &PendingPack{
+		u:              u,
+		z:              zipread.NewWriter(counter),
+		counter:        counter,
+		autoSampleSize: opts.AutoSampleSize,
+		autoMinSavings: opts.AutoMinSavings,
+		deterministic:  opts.Deterministic,
+		digests:        opts.Digests,
+		normalizeNames: opts.NormalizeNames,
+		names:          make(map[string]nameKind),
+	}
+	if p.deterministic {
+		modTime, err := deterministicModTime(opts.ModTime)
+		if err != nil {
+			return nil, err
+		}
+		p.modTime = modTime
+	}
+	if deflate != nil {
+		p.z.RegisterCompressor(zipread.Deflate, deflate)
+	}
+	if p.autoSampleSize <= 0 {
+		p.autoSampleSize = defaultAutoSampleSize
+	}
+	if p.autoMinSavings <= 0 {
+		p.autoMinSavings = defaultAutoMinSavings
+	}
+	if opts.Dedup {
+		p.dedup = newDedup()
+	}
+	if concurrency := opts.Concurrency; concurrency > 1 || p.dedup != nil {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		p.par = newParallel(p, concurrency, opts.MemoryBudget, opts.TempDir)
+	}
+	return p, nil
 }
 
+// RegisterCompressor registers or overrides the compressor used for
+// entries with the given method, like zipread.Writer.RegisterCompressor.
+// Entries select a custom method with FileHeader.Method, and readers
+// need a matching Pack.RegisterDecompressor.
+func (p *PendingPack) RegisterCompressor(method uint16, comp zipread.Compressor) {
+	p.z.RegisterCompressor(method, comp)
+}
+
+// SetComment sets the archive comment, which zip tools show when listing
+// the pack. It is followed by a short trailer describing the pack's central
+// directory, and can be at most 65485 bytes long. Packs written to a
+// FileDestination keeping the metadata in the comment cannot have one.
+func (p *PendingPack) SetComment(comment string) error {
+	if len(comment) > maxCommentLen {
+		return errs.Errorf("comment too long")
+	}
+	if cm, ok := p.u.(commentMetadata); ok && cm.metadataInComment() && comment != "" {
+		return errs.Errorf("the destination keeps the metadata in the archive comment")
+	}
+	p.comment = comment
+	return nil
+}
+
+// SetCustomMetadata sets the custom metadata the pack is committed with,
+// next to the pack's own. If the destination keeps the metadata in the
+// archive comment and it would not fit there, Commit fails and aborts the
+// pack, without waiting for the remaining entries to be written.
 func (p *PendingPack) SetCustomMetadata(custom uplink.CustomMetadata) {
+	p.metaErr = nil
+	if cm, ok := p.u.(commentMetadata); ok && cm.metadataInComment() {
+		p.metaErr = checkCommentMetadata(cm, custom)
+	}
 	if custom != nil {
 		custom = custom.Clone()
 	}
@@ -52,59 +275,298 @@ type FileHeader struct {
 	Comment      string
 	Modified     time.Time
 	Uncompressed bool
+
+	// Compression selects how the entry is stored. The default deflates
+	// the entry unless Uncompressed is set.
+	Compression Compression
+
+	// Method, if nonzero, is the ZIP compression method of the entry and
+	// overrides Compression. Methods other than Deflate need a compressor
+	// registered with PendingPack.RegisterCompressor.
+	Method uint16
+
+	// Mode holds the permission and type bits of the entry. Zero means
+	// a regular file with default permissions.
+	Mode fs.FileMode
+
+	// UID and GID are the entry's owner. They are stored in an Info-ZIP
+	// Unix extra field if either is nonzero.
+	UID, GID int
+
+	// AccessTime and CreationTime are stored alongside Modified in an
+	// extended timestamp extra field, if set.
+	AccessTime   time.Time
+	CreationTime time.Time
+}
+
+// zipHeader converts h into the header written for the entry name.
+func (h *FileHeader) zipHeader(name string) *zipread.FileHeader {
+	header := &zipread.FileHeader{
+		Name:     name,
+		Comment:  h.Comment,
+		Modified: h.Modified,
+	}
+	if h.Mode != 0 {
+		header.SetMode(h.Mode)
+	}
+	if !h.AccessTime.IsZero() || !h.CreationTime.IsZero() {
+		header.Extra = append(header.Extra, zipread.ExtendedTimeExtra(h.Modified, h.AccessTime, h.CreationTime)...)
+	}
+	if h.UID != 0 || h.GID != 0 {
+		header.Extra = append(header.Extra, zipread.UnixOwnerExtra(h.UID, h.GID)...)
+	}
+	return header
 }
 
 type FileWriter struct {
 	io.Writer
 	contentOffset int64
+
+	pack   *PendingPack
+	header *zipread.FileHeader
+	auto   *autoWriter // set for CompressionAuto when not concurrent
+	job    *entryJob   // set when compressing concurrently
+	digest hash.Hash   // set when recording digests or deduplicating
+	done   bool
 }
 
 // ContentOffset is the offset relative to the start of the ZIP archive.
 // FileWriter will start writing at this position.
 // Clients can keep track of this offset if they want to efficiently
 // download the file without reading the central directory entry.
+// For entries using CompressionAuto, the offset is only known once the
+// compression has been decided, which is at the latest when the entry
+// is finished. When compressing concurrently, it is only known once
+// Locator is available.
 func (fw *FileWriter) ContentOffset() int64 {
 	return fw.contentOffset
 }
 
+// Close finishes the entry. Calling it is optional, since the entry is
+// also finished by the next call to Add or by Commit, but it makes the
+// entry's Locator available right away.
+func (fw *FileWriter) Close() error {
+	return fw.pack.finish(fw)
+}
+
+// Locator returns what OpenEntryAt needs to read this entry back directly.
+// It is only available once the entry is finished, or, when compressing
+// concurrently, once it has been written to the pack, which is at the
+// latest on Commit.
+func (fw *FileWriter) Locator() (EntryLocator, bool) {
+	if !fw.done {
+		return EntryLocator{}, false
+	}
+	return EntryLocator{
+		ContentOffset:  fw.contentOffset,
+		CompressedSize: int64(fw.header.CompressedSize64),
+		Method:         fw.header.Method,
+		CRC32:          fw.header.CRC32,
+		Size:           int64(fw.header.UncompressedSize64),
+	}, true
+}
+
+// finish finishes fw if it is still the entry being written.
+func (p *PendingPack) finish(fw *FileWriter) error {
+	if fw == nil || fw != p.cur {
+		return nil
+	}
+	p.cur = nil
+	if fw.job != nil {
+		if p.dedup != nil {
+			p.dedup.check(fw.job, fw.digest)
+		}
+		return p.submit(fw.job)
+	}
+	if fw.auto != nil {
+		if err := fw.auto.decide(); err != nil {
+			return err
+		}
+	}
+	if err := p.z.CloseEntry(); err != nil {
+		return err
+	}
+	fw.addDigest()
+	fw.done = true
+	return nil
+}
+
+// checkpoint lets the destination record the progress made so far, if it
+// does. It is called before an entry is added, once the previous ones have
+// been finished, so that the destination gets the context of the call.
+func (p *PendingPack) checkpoint(ctx context.Context) error {
+	cp, ok := p.u.(checkpointer)
+	if !ok {
+		return nil
+	}
+	if err := p.z.Flush(); err != nil {
+		return err
+	}
+	return cp.checkpoint(ctx, p.z, p.dedup)
+}
+
+// Entries returns the names of the entries written to the pack so far.
+// When compressing concurrently, entries still being compressed are not
+// included. After ResumePack, these are the entries that were kept.
+func (p *PendingPack) Entries() []string {
+	names := make([]string, 0, p.z.NumEntries())
+	for i, n := 0, p.z.NumEntries(); i < n; i++ {
+		fh, _ := p.z.Entry(i)
+		names = append(names, fh.Name)
+	}
+	return names
+}
+
+// addDigest records the digest of fw's content, if computed. The entry's
+// local header has already been written by then, so the digest ends up in
+// the central directory only.
+func (fw *FileWriter) addDigest() {
+	if fw.pack.digests {
+		fw.header.Extra = append(fw.header.Extra, zipread.DigestExtra(fw.digest.Sum(nil))...)
+	}
+}
+
+// createEntry writes the local header for fw and returns the writer
+// for its content.
+func (p *PendingPack) createEntry(fw *FileWriter) (io.Writer, error) {
+	w, err := p.z.CreateHeader(fw.header)
+	if err != nil {
+		return nil, err
+	}
+	// Flush the ZIP writer to ensure that p.counter will count the header.
+	err = p.z.Flush()
+	if err != nil {
+		return nil, err
+	}
+	fw.contentOffset = p.counter.N
+	return w, nil
+}
+
+// Add adds a file entry and returns the writer for its content. name must
+// be a valid io/fs path that is not yet in the pack; see ErrInvalidName,
+// ErrDuplicateName and CreateOptions.NormalizeNames.
 func (p *PendingPack) Add(ctx context.Context, name string, options *FileHeader) (*FileWriter, error) {
 	if strings.HasSuffix(name, "/") {
-		return nil, errs.Errorf("adding directories to packs not supported")
+		return nil, errs.Errorf("use AddDir to add directories to packs")
 	}
 	if options == nil {
 		options = &FileHeader{}
 	}
-	header := &zip.FileHeader{
-		Name:     name,
-		Comment:  options.Comment,
-		Modified: options.Modified,
-		Method:   zip.Store,
+	if options.Mode.IsDir() {
+		return nil, errs.Errorf("use AddDir to add directories to packs")
 	}
-	if options.Uncompressed {
-		header.Method = zip.Store
-	} else {
-		header.Method = zip.Deflate
+	if err := p.finish(p.cur); err != nil {
+		return nil, err
 	}
-	w, err := p.z.CreateHeader(header)
-	if err != nil {
+	if err := p.checkpoint(ctx); err != nil {
 		return nil, err
 	}
-	// Flush the ZIP writer to ensure that p.counter will count the header.
-	err = p.z.Flush()
+	name, err := p.entryName("add", name)
 	if err != nil {
 		return nil, err
 	}
-	return &FileWriter{
-		Writer:        w,
-		contentOffset: p.counter.N,
-	}, nil
+	fw := &FileWriter{
+		pack:   p,
+		header: p.zipHeader(name, options),
+	}
+	compression := options.compression()
+	switch compression {
+	case compressionMethod:
+		fw.header.Method = options.Method
+	case CompressionAuto:
+		// Decided once enough content has been written.
+	case CompressionStore:
+		fw.header.Method = zipread.Store
+	default:
+		fw.header.Method = zipread.Deflate
+	}
+	switch {
+	case p.par != nil:
+		fw.job = &entryJob{
+			header: fw.header,
+			fw:     fw,
+			auto:   compression == CompressionAuto,
+			raw:    p.par.newBuffer(),
+			done:   make(chan struct{}),
+		}
+		fw.Writer = fw.job.raw
+	case compression == CompressionAuto:
+		// The header can only be written once the method is known.
+		fw.auto = &autoWriter{fw: fw}
+		fw.Writer = fw.auto
+	default:
+		w, err := p.createEntry(fw)
+		if err != nil {
+			return nil, err
+		}
+		fw.Writer = w
+	}
+	p.reserveName(name)
+	if p.digests || p.dedup != nil {
+		fw.digest = sha256.New()
+		fw.Writer = io.MultiWriter(fw.digest, fw.Writer)
+	}
+	p.cur = fw
+	return fw, nil
+}
+
+// AddDir adds a directory entry, so that empty directories and directory
+// attributes survive packing. A trailing slash is added to name if missing.
+// If options.Mode has no permission bits, 0755 is used.
+func (p *PendingPack) AddDir(ctx context.Context, name string, options *FileHeader) error {
+	if options == nil {
+		options = &FileHeader{}
+	}
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	if err := p.finish(p.cur); err != nil {
+		return err
+	}
+	if err := p.checkpoint(ctx); err != nil {
+		return err
+	}
+	name, err := p.entryName("add", name)
+	if err != nil {
+		return err
+	}
+	header := p.zipHeader(name, options)
+	mode := options.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) | fs.ModeDir
+	if mode.Perm() == 0 || p.deterministic {
+		mode |= 0755
+	}
+	header.SetMode(mode)
+	if p.par != nil {
+		done := make(chan struct{})
+		close(done)
+		err = p.submit(&entryJob{header: header, done: done})
+	} else {
+		_, err = p.z.CreateHeader(header)
+	}
+	if err != nil {
+		return err
+	}
+	p.reserveName(name)
+	return nil
 }
 
 func (p *PendingPack) Commit(ctx context.Context) error {
-	err := p.z.Flush()
+	if p.metaErr != nil {
+		return errs.Combine(p.metaErr, p.Abort())
+	}
+	err := p.finish(p.cur)
+	if p.par != nil {
+		if err == nil {
+			err = p.drain()
+		}
+		err = errs.Combine(err, p.par.close())
+	}
+	if err == nil {
+		err = p.z.Flush()
+	}
 	if err != nil {
 		err = errs.Combine(err, p.z.Close())
-		return errs.Combine(err, p.u.Abort())
+		return errs.Combine(err, p.u.Abort(ctx))
 	}
 
 	custom := p.meta
@@ -112,26 +574,44 @@ func (p *PendingPack) Commit(ctx context.Context) error {
 		custom = make(uplink.CustomMetadata, 2)
 	}
 
-	custom[directoryOffsetKey] = strconv.FormatInt(p.counter.N, 16)
+	p.dirOff = p.counter.N
+	p.setMetadata(custom)
 	if _, set := custom[contentTypeKey]; !set {
 		custom[contentTypeKey] = contentTypeZip
 	}
 
 	err = p.u.SetCustomMetadata(ctx, custom)
+	comment := p.comment
+	if cm, ok := p.u.(commentMetadata); ok && err == nil {
+		var meta string
+		meta, err = cm.metadataComment(custom)
+		if err == nil && meta != "" {
+			comment = meta
+		}
+	}
+	if err == nil {
+		err = p.z.SetComment(appendTrailer(comment, p.dirOff, p.z.DirectorySize()))
+	}
 	if err != nil {
 		err = errs.Combine(err, p.z.Close())
-		return errs.Combine(err, p.u.Abort())
+		return errs.Combine(err, p.u.Abort(ctx))
 	}
 
 	err = p.z.Close()
 	if err != nil {
-		return errs.Combine(err, p.u.Abort())
+		return errs.Combine(err, p.u.Abort(ctx))
 	}
-	return p.u.Commit()
+	return p.u.Commit(ctx)
 }
 
+// Abort discards the pack. It is not bound to a context, so that it can
+// clean up after a call failed because its context was canceled.
 func (p *PendingPack) Abort() error {
-	return p.u.Abort()
+	ctx := context.Background()
+	if p.par != nil {
+		return errs.Combine(p.par.close(), p.u.Abort(ctx))
+	}
+	return p.u.Abort(ctx)
 }
 
 type countingWriter struct {
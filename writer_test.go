@@ -0,0 +1,539 @@
+package zipper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"storj.io/uplink"
+	"storj.io/zipper/zipread"
+)
+
+func TestPackDigests(t *testing.T) {
+	ctx := context.Background()
+	for _, concurrency := range []int{0, 4} {
+		u := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, u, &CreateOptions{Digests: true, Concurrency: concurrency})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := map[string]string{
+			"a.txt": strings.Repeat("a", 100000),
+			"b.txt": "b",
+			"c.txt": "",
+		}
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			w, err := p.Add(ctx, name, &FileHeader{Compression: CompressionAuto})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, contents[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		z, err := zipread.OpenWithOptions(zipread.SourceFromReaderAt(bytes.NewReader(u.Bytes()), int64(len(u.Bytes()))),
+			&zipread.Options{VerifyDigests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range contents {
+			sum := sha256.Sum256([]byte(content))
+			f, err := z.LookupDigest(sum[:])
+			if err != nil {
+				t.Fatalf("concurrency=%d: %s: %v", concurrency, name, err)
+			}
+			if f.Name != name {
+				t.Errorf("concurrency=%d: digest of %s found %s", concurrency, name, f.Name)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("concurrency=%d: %s: %v", concurrency, name, err)
+			}
+			_ = rc.Close()
+			if string(got) != content {
+				t.Errorf("concurrency=%d: %s: wrong content", concurrency, name)
+			}
+		}
+	}
+}
+
+func TestFileDestination(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, inComment := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("pack-%t.zip", inComment))
+		dst, err := CreateFileDestination(path, &FileDestinationOptions{MetadataInComment: inComment})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := CreatePackTo(ctx, dst, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetComment("comment"); (err != nil) != inComment {
+			t.Fatalf("inComment=%t: SetComment returned %v", inComment, err)
+		}
+		w, err := p.Add(ctx, "a.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, "hello"); err != nil {
+			t.Fatal(err)
+		}
+		// Only the last metadata set counts.
+		p.SetCustomMetadata(uplink.CustomMetadata{"huge": strings.Repeat("<", maxCommentLen/4)})
+		p.SetCustomMetadata(uplink.CustomMetadata{"owner": "someone"})
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("inComment=%t: pack visible before commit: %v", inComment, err)
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		sidecar := path + ".meta.json"
+		if inComment {
+			sidecar = ""
+			if _, err := os.Stat(path + ".meta.json"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("unexpected sidecar: %v", err)
+			}
+		}
+		custom, err := ReadFileMetadata(path, sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if custom["owner"] != "someone" || custom[contentTypeKey] != contentTypeZip {
+			t.Errorf("inComment=%t: metadata %v", inComment, custom)
+		}
+		offset, err := strconv.ParseInt(custom[directoryOffsetKey], 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(z.File) != 1 || z.File[0].Name != "a.txt" {
+			t.Fatalf("inComment=%t: unexpected entries", inComment)
+		}
+		if got := binary.LittleEndian.Uint32(data[offset:]); got != 0x02014b50 {
+			t.Errorf("inComment=%t: no central directory at offset %d", inComment, offset)
+		}
+	}
+
+	dst, err := CreateFileDestination(filepath.Join(dir, "aborted.zip"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := CreatePackTo(ctx, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata too large for the comment fails the commit.
+	dst, err = CreateFileDestination(filepath.Join(dir, "aborted-huge.zip"), &FileDestinationOptions{MetadataInComment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = CreatePackTo(ctx, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetCustomMetadata(uplink.CustomMetadata{"huge": strings.Repeat("<", maxCommentLen/4)})
+	if _, err := p.Add(ctx, "a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err == nil {
+		t.Error("committed metadata too large for the comment")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "aborted") {
+			t.Errorf("left behind %s", e.Name())
+		}
+	}
+}
+
+func TestCommitWithManifest(t *testing.T) {
+	ctx := context.Background()
+	for _, concurrency := range []int{0, 4} {
+		u := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, u, &CreateOptions{Concurrency: concurrency, Digests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := []string{strings.Repeat("compressible ", 1000), "tiny", ""}
+		for i, content := range contents {
+			w, err := p.Add(ctx, fmt.Sprintf("%d.txt", i), &FileHeader{Compression: CompressionAuto})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.AddDir(ctx, "dir", nil); err != nil {
+			t.Fatal(err)
+		}
+		m, err := p.CommitWithManifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := u.Bytes()
+		if m.Object != nil || m.Size != int64(len(data)) {
+			t.Fatalf("concurrency=%d: object %v, size %d", concurrency, m.Object, m.Size)
+		}
+		if offset := u.CustomMetadata()[directoryOffsetKey]; offset != strconv.FormatInt(m.DirectoryOffset, 16) {
+			t.Errorf("concurrency=%d: directory offset %d, metadata says %s", concurrency, m.DirectoryOffset, offset)
+		}
+
+		z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Entries) != len(z.File) {
+			t.Fatalf("concurrency=%d: %d manifest entries, %d in pack", concurrency, len(m.Entries), len(z.File))
+		}
+		for i, e := range m.Entries {
+			f := z.File[i]
+			if e.Name != f.Name || e.Method != f.Method || e.CRC32 != f.CRC32 ||
+				e.CompressedSize != int64(f.CompressedSize64) || e.UncompressedSize != int64(f.UncompressedSize64) {
+				t.Errorf("concurrency=%d: entry %d is %+v, pack has %+v", concurrency, i, e, f.FileHeader)
+			}
+			if got := binary.LittleEndian.Uint32(data[e.HeaderOffset:]); got != 0x04034b50 {
+				t.Errorf("concurrency=%d: %s: no local header at %d", concurrency, e.Name, e.HeaderOffset)
+			}
+			if i >= len(contents) {
+				continue
+			}
+			rc, err := zipread.NewEntryReader(io.NopCloser(bytes.NewReader(data[e.ContentOffset:e.ContentOffset+e.CompressedSize])),
+				e.Method, e.CRC32, uint64(e.UncompressedSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("concurrency=%d: %s: %v", concurrency, e.Name, err)
+			}
+			if string(got) != contents[i] {
+				t.Errorf("concurrency=%d: %s: wrong content", concurrency, e.Name)
+			}
+		}
+	}
+}
+
+func TestAddNames(t *testing.T) {
+	ctx := context.Background()
+	p, err := CreatePackTo(ctx, new(MemoryDestination), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "../x", "/abs", "a/../b", "a//b", `a\b`, "./a"} {
+		if _, err := p.Add(ctx, name, nil); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Add(%q): got %v, want ErrInvalidName", name, err)
+		}
+	}
+	if err := p.AddDir(ctx, "../d", nil); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("AddDir: got %v, want ErrInvalidName", err)
+	}
+	if _, err := p.Add(ctx, "a/b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Add(ctx, "a/b", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("duplicate Add: got %v, want ErrDuplicateName", err)
+	}
+	if err := p.AddDir(ctx, "a/b", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("AddDir of a file's name: got %v, want ErrDuplicateName", err)
+	}
+	// Files may not share a name with a directory, even an implicit one.
+	if _, err := p.Add(ctx, "a", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("Add of a parent's name: got %v, want ErrDuplicateName", err)
+	}
+	if _, err := p.Add(ctx, "a/b/c", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("Add below a file: got %v, want ErrDuplicateName", err)
+	}
+	if err := p.AddDir(ctx, "a/b/d", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("AddDir below a file: got %v, want ErrDuplicateName", err)
+	}
+	if err := p.AddDir(ctx, "a", nil); err != nil {
+		t.Errorf("AddDir of a parent's name: %v", err)
+	}
+	if err := p.AddDir(ctx, "a", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("duplicate AddDir: got %v, want ErrDuplicateName", err)
+	}
+	var pathErr *fs.PathError
+	if _, err := p.Add(ctx, "a/b", nil); !errors.As(err, &pathErr) || pathErr.Path != "a/b" {
+		t.Errorf("duplicate Add: got %v, want a PathError for a/b", err)
+	}
+	// A name is only taken once its entry is created.
+	if _, err := p.Add(ctx, "c", &FileHeader{Method: 99}); !errors.Is(err, zipread.ErrAlgorithm) {
+		t.Errorf("Add with an unknown method: got %v, want ErrAlgorithm", err)
+	}
+	if _, err := p.Add(ctx, "c", nil); err != nil {
+		t.Errorf("Add after a failed Add: %v", err)
+	}
+	if _, err := p.Add(ctx, "c/d", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("Add below a file: got %v, want ErrDuplicateName", err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	u := new(MemoryDestination)
+	p, err = CreatePackTo(ctx, u, &CreateOptions{NormalizeNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`\win\path.txt`, "/abs/x", "../../up", "./a/./b"} {
+		if _, err := p.Add(ctx, name, nil); err != nil {
+			t.Fatalf("Add(%q): %v", name, err)
+		}
+	}
+	if err := p.AddDir(ctx, "/d/../dir/", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"..", "/..", `\`} {
+		if _, err := p.Add(ctx, name, nil); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Add(%q): got %v, want ErrInvalidName", name, err)
+		}
+	}
+	if _, err := p.Add(ctx, "/up", nil); !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("normalized duplicate: got %v, want ErrDuplicateName", err)
+	}
+	m, err := p.CommitWithManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range m.Entries {
+		names = append(names, e.Name)
+	}
+	if got, want := strings.Join(names, " "), "win/path.txt abs/x up a/b dir/"; got != want {
+		t.Errorf("got names %q, want %q", got, want)
+	}
+}
+
+func TestPackDedup(t *testing.T) {
+	ctx := context.Background()
+	license := strings.Repeat("Permission is hereby granted, free of charge. ", 200)
+	contents := map[string]string{
+		"a/LICENSE":   license,
+		"b/LICENSE":   license,
+		"c/other.txt": "something else",
+		"d/LICENSE":   license,
+	}
+	names := []string{"a/LICENSE", "b/LICENSE", "c/other.txt", "d/LICENSE"}
+	build := func(dedup bool, concurrency int) (*MemoryDestination, *PackManifest) {
+		u := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, u, &CreateOptions{Dedup: dedup, Concurrency: concurrency, Digests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range names {
+			compression := CompressionDeflate
+			if i == 3 {
+				compression = CompressionStore
+			}
+			w, err := p.Add(ctx, name, &FileHeader{Compression: compression})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, contents[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m, err := p.CommitWithManifest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u, m
+	}
+
+	plain, _ := build(false, 0)
+	for _, concurrency := range []int{0, 4} {
+		u, m := build(true, concurrency)
+		if len(u.Bytes()) >= len(plain.Bytes())-2*len(license)/10 {
+			t.Errorf("concurrency=%d: deduplicated pack is %d bytes, plain one %d", concurrency, len(u.Bytes()), len(plain.Bytes()))
+		}
+		first := m.Entries[0]
+		for _, i := range []int{1, 3} {
+			if e := m.Entries[i]; e.ContentOffset != first.ContentOffset || e.HeaderOffset != first.HeaderOffset ||
+				e.Method != first.Method {
+				t.Errorf("concurrency=%d: %s does not share the data of %s", concurrency, e.Name, first.Name)
+			}
+		}
+		if m.Entries[2].ContentOffset == first.ContentOffset {
+			t.Errorf("concurrency=%d: distinct content was deduplicated", concurrency)
+		}
+
+		z, err := zipread.OpenWithOptions(zipread.SourceFromReaderAt(bytes.NewReader(u.Bytes()), int64(len(u.Bytes()))),
+			&zipread.Options{VerifyDigests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			got, err := fs.ReadFile(z, name)
+			if err != nil {
+				t.Fatalf("concurrency=%d: %s: %v", concurrency, name, err)
+			}
+			if string(got) != contents[name] {
+				t.Errorf("concurrency=%d: %s: wrong content", concurrency, name)
+			}
+		}
+	}
+}
+
+func TestPackStats(t *testing.T) {
+	ctx := context.Background()
+	u := new(MemoryDestination)
+	p, err := CreatePackTo(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b/c.txt"} {
+		w, err := p.Add(ctx, name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, strings.Repeat(name, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddDir(ctx, "d", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetComment(strings.Repeat("x", 1<<16)); err == nil {
+		t.Fatal("overlong comment accepted")
+	}
+	if err := p.SetComment("built by the test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data := u.Bytes()
+	info := &uplink.Object{Custom: u.CustomMetadata()}
+	info.System.ContentLength = int64(len(data))
+	stats, ok := statsFromObject(info)
+	if !ok {
+		t.Fatalf("no stats in %v", info.Custom)
+	}
+	want := PackStats{
+		Entries:          3,
+		UncompressedSize: 100 * int64(len("a.txt")+len("b/c.txt")),
+		Size:             int64(len(data)),
+		DirectoryOffset:  stats.DirectoryOffset,
+		DirectorySize:    int64(len(data)) - stats.DirectoryOffset - 22 - int64(len("built by the test")+trailerLen),
+		WriterVersion:    metadataVersion,
+	}
+	if *stats != want {
+		t.Errorf("got stats %+v, want %+v", *stats, want)
+	}
+
+	z, err := zipread.Open(zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := &Pack{zr: z, size: int64(len(data)), dirOffset: stats.DirectoryOffset}
+	if pack.Comment() != "built by the test" {
+		t.Errorf("got comment %q", pack.Comment())
+	}
+	want.WriterVersion = -1
+	if got := pack.Stats(); *got != want {
+		t.Errorf("counted stats %+v, want %+v", *got, want)
+	}
+}
+
+// countingSource counts the requests made to a Source.
+type countingSource struct {
+	zipread.Source
+	requests int
+}
+
+func (s *countingSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.requests++
+	return s.Source.Range(ctx, offset, length)
+}
+
+func (s *countingSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	s.requests++
+	return s.Source.RangeFromEnd(ctx, length)
+}
+
+func TestOpenWithoutMetadata(t *testing.T) {
+	ctx := context.Background()
+	for _, entries := range []int{10, 3000} {
+		u := new(MemoryDestination)
+		p, err := CreatePackTo(ctx, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.SetComment("user comment"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < entries; i++ {
+			if _, err := p.Add(ctx, fmt.Sprintf("some/fairly/long/directory/name/entry-%06d.txt", i), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		data := u.Bytes()
+		dirOffset, err := strconv.ParseInt(u.CustomMetadata()[directoryOffsetKey], 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source := &countingSource{Source: zipread.SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))}
+		pack, err := openSource(ctx, source, int64(len(data)), -1, &OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if int64(len(data))-dirOffset > minTailSearchSize {
+			want = 2
+		}
+		if source.requests != want {
+			t.Errorf("entries=%d: opened with %d requests, want %d", entries, source.requests, want)
+		}
+		if pack.dirOffset != dirOffset || !pack.IsPackagePack() {
+			t.Errorf("entries=%d: directory offset %d, want %d", entries, pack.dirOffset, dirOffset)
+		}
+		if len(pack.List()) != entries || pack.Comment() != "user comment" {
+			t.Errorf("entries=%d: got %d entries and comment %q", entries, len(pack.List()), pack.Comment())
+		}
+		if err := pack.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
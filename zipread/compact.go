@@ -0,0 +1,282 @@
+package zipread
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// compactIndex is a memory efficient representation of a central
+// directory. Names and comments are kept in a single arena and everything
+// else parsed from an entry's header is kept in fixed-size records.
+type compactIndex struct {
+	names   []byte // each name, followed by its comment
+	digests []byte // SHA-256 digests, for the records that have one
+	records []compactRecord
+
+	// owners holds the UID and GID of records whose owner does not fit
+	// in the record.
+	owners map[uint32][2]int
+
+	// order lists record indexes sorted by name (without any trailing
+	// slash), for binary search. Records whose names are not already
+	// valid fs paths are found through aliases instead.
+	order   []uint32
+	aliases map[string][]uint32
+}
+
+type compactRecord struct {
+	headerOffset     int64
+	compressedSize   uint64
+	uncompressedSize uint64
+	nameOffset       int64
+	modifiedSec      int64
+	modifiedNsec     int32
+	modifiedZone     int32 // offset in seconds, if compactFixedZone is set
+	crc32            uint32
+	externalAttrs    uint32
+	digest           uint32 // 1 + index into digests, or 0
+	uid, gid         uint32
+	accessTime       uint32 // seconds since the epoch, if compactAccessTime is set
+	creationTime     uint32 // seconds since the epoch, if compactCreationTime is set
+	nameLen          uint16
+	commentLen       uint16
+	creatorVersion   uint16
+	readerVersion    uint16
+	flags            uint16
+	method           uint16
+	modifiedDate     uint16
+	modifiedTime     uint16
+	bits             uint8
+}
+
+const (
+	compactNonUTF8 = 1 << iota
+	compactFixedZone
+	compactZip64Compressed   // the 32-bit compressed size was maxed out
+	compactZip64Uncompressed // the 32-bit uncompressed size was maxed out
+	compactAccessTime
+	compactCreationTime
+	compactWideOwner // the owner is in compactIndex.owners
+)
+
+func (c *compactIndex) grow(records uint64) {
+	// The record count is only a hint, since it may be truncated or bogus.
+	if records > 1<<20 {
+		records = 1 << 20
+	}
+	c.records = make([]compactRecord, 0, records)
+}
+
+func (c *compactIndex) add(f *File) {
+	rec := compactRecord{
+		headerOffset:     f.headerOffset,
+		compressedSize:   f.CompressedSize64,
+		uncompressedSize: f.UncompressedSize64,
+		nameOffset:       int64(len(c.names)),
+		modifiedSec:      f.Modified.Unix(),
+		modifiedNsec:     int32(f.Modified.Nanosecond()),
+		crc32:            f.CRC32,
+		externalAttrs:    f.ExternalAttrs,
+		nameLen:          uint16(len(f.Name)),
+		commentLen:       uint16(len(f.Comment)),
+		creatorVersion:   f.CreatorVersion,
+		readerVersion:    f.ReaderVersion,
+		flags:            f.Flags,
+		method:           f.Method,
+		modifiedDate:     f.ModifiedDate,
+		modifiedTime:     f.ModifiedTime,
+	}
+	if f.NonUTF8 {
+		rec.bits |= compactNonUTF8
+	}
+	if f.CompressedSize == uint32max {
+		rec.bits |= compactZip64Compressed
+	}
+	if f.UncompressedSize == uint32max {
+		rec.bits |= compactZip64Uncompressed
+	}
+	if f.Modified.Location() != time.UTC {
+		_, offset := f.Modified.Zone()
+		rec.modifiedZone = int32(offset)
+		rec.bits |= compactFixedZone
+	}
+	if !f.AccessTime.IsZero() {
+		rec.accessTime = uint32(f.AccessTime.Unix())
+		rec.bits |= compactAccessTime
+	}
+	if !f.CreationTime.IsZero() {
+		rec.creationTime = uint32(f.CreationTime.Unix())
+		rec.bits |= compactCreationTime
+	}
+	if f.UID == int(uint32(f.UID)) && f.GID == int(uint32(f.GID)) {
+		rec.uid, rec.gid = uint32(f.UID), uint32(f.GID)
+	} else {
+		if c.owners == nil {
+			c.owners = make(map[uint32][2]int)
+		}
+		c.owners[uint32(len(c.records))] = [2]int{f.UID, f.GID}
+		rec.bits |= compactWideOwner
+	}
+	if f.digest != nil {
+		rec.digest = uint32(len(c.digests)/sha256.Size) + 1
+		c.digests = append(c.digests, f.digest...)
+	}
+	c.names = append(c.names, f.Name...)
+	c.names = append(c.names, f.Comment...)
+	c.records = append(c.records, rec)
+}
+
+func (c *compactIndex) name(i uint32) []byte {
+	rec := &c.records[i]
+	return c.names[rec.nameOffset : rec.nameOffset+int64(rec.nameLen)]
+}
+
+// key is the name used for lookups, which is the name without
+// any trailing slash.
+func (c *compactIndex) key(i uint32) []byte {
+	name := c.name(i)
+	if len(name) > 0 && name[len(name)-1] == '/' {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+// index builds the lookup structures once all records have been added.
+func (c *compactIndex) index() {
+	c.order = make([]uint32, 0, len(c.records))
+	for i := range c.records {
+		key := string(c.key(uint32(i)))
+		if valid := toValidName(key); valid != key {
+			if c.aliases == nil {
+				c.aliases = make(map[string][]uint32)
+			}
+			c.aliases[valid] = append(c.aliases[valid], uint32(i))
+			continue
+		}
+		c.order = append(c.order, uint32(i))
+	}
+	sort.SliceStable(c.order, func(i, j int) bool {
+		return bytes.Compare(c.key(c.order[i]), c.key(c.order[j])) < 0
+	})
+}
+
+func (c *compactIndex) file(z *Reader, i int) *File {
+	rec := &c.records[i]
+	f := &File{
+		zip:          z,
+		zips:         z.source,
+		zipsize:      z.size,
+		headerOffset: rec.headerOffset,
+	}
+	f.Name = string(c.name(uint32(i)))
+	start := rec.nameOffset + int64(rec.nameLen)
+	f.Comment = string(c.names[start : start+int64(rec.commentLen)])
+	f.CreatorVersion = rec.creatorVersion
+	f.ReaderVersion = rec.readerVersion
+	f.Flags = rec.flags
+	f.Method = rec.method
+	f.ModifiedDate = rec.modifiedDate
+	f.ModifiedTime = rec.modifiedTime
+	f.CRC32 = rec.crc32
+	f.CompressedSize64 = rec.compressedSize
+	f.UncompressedSize64 = rec.uncompressedSize
+	f.CompressedSize = uint32(rec.compressedSize)
+	if rec.bits&compactZip64Compressed != 0 {
+		f.CompressedSize = uint32max
+	}
+	f.UncompressedSize = uint32(rec.uncompressedSize)
+	if rec.bits&compactZip64Uncompressed != 0 {
+		f.UncompressedSize = uint32max
+	}
+	f.ExternalAttrs = rec.externalAttrs
+	f.NonUTF8 = rec.bits&compactNonUTF8 != 0
+	f.UID, f.GID = int(rec.uid), int(rec.gid)
+	if rec.bits&compactWideOwner != 0 {
+		owner := c.owners[uint32(i)]
+		f.UID, f.GID = owner[0], owner[1]
+	}
+	if rec.bits&compactAccessTime != 0 {
+		f.AccessTime = time.Unix(int64(rec.accessTime), 0).UTC()
+	}
+	if rec.bits&compactCreationTime != 0 {
+		f.CreationTime = time.Unix(int64(rec.creationTime), 0).UTC()
+	}
+	if rec.digest != 0 {
+		start := int(rec.digest-1) * sha256.Size
+		f.digest = c.digests[start : start+sha256.Size : start+sha256.Size]
+	}
+	f.Modified = time.Unix(rec.modifiedSec, int64(rec.modifiedNsec)).UTC()
+	if rec.bits&compactFixedZone != 0 {
+		f.Modified = f.Modified.In(time.FixedZone("", int(rec.modifiedZone)))
+	}
+	return f
+}
+
+// lookup finds the first regular file named name, which must be a
+// valid fs path.
+func (c *compactIndex) lookup(z *Reader, name string) (*File, error) {
+	isDir := name == "."
+	i := sort.Search(len(c.order), func(i int) bool {
+		return string(c.key(c.order[i])) >= name
+	})
+	for ; i < len(c.order) && string(c.key(c.order[i])) == name; i++ {
+		if !bytes.HasSuffix(c.name(c.order[i]), []byte("/")) {
+			return c.file(z, int(c.order[i])), nil
+		}
+		isDir = true
+	}
+	for _, j := range c.aliases[name] {
+		if !bytes.HasSuffix(c.name(j), []byte("/")) {
+			return c.file(z, int(j)), nil
+		}
+		isDir = true
+	}
+	if !isDir {
+		isDir = c.hasPrefix(name + "/")
+	}
+	if isDir {
+		return nil, errs.Errorf("not a file")
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// lookupDir finds the first directory entry named name, which must be a
+// valid fs path.
+func (c *compactIndex) lookupDir(z *Reader, name string) (*File, error) {
+	i := sort.Search(len(c.order), func(i int) bool {
+		return string(c.key(c.order[i])) >= name
+	})
+	for ; i < len(c.order) && string(c.key(c.order[i])) == name; i++ {
+		if bytes.HasSuffix(c.name(c.order[i]), []byte("/")) {
+			return c.file(z, int(c.order[i])), nil
+		}
+	}
+	for _, j := range c.aliases[name] {
+		if bytes.HasSuffix(c.name(j), []byte("/")) {
+			return c.file(z, int(j)), nil
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// hasPrefix reports whether any entry lives below the directory prefix.
+func (c *compactIndex) hasPrefix(prefix string) bool {
+	i := sort.Search(len(c.order), func(i int) bool {
+		return string(c.key(c.order[i])) >= prefix
+	})
+	if i < len(c.order) && strings.HasPrefix(string(c.key(c.order[i])), prefix) {
+		return true
+	}
+	for alias := range c.aliases {
+		if strings.HasPrefix(alias, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package zipread
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCompactReader(t *testing.T) {
+	for _, zt := range tests {
+		if zt.Error != nil || zt.Source != nil {
+			continue
+		}
+		zt := zt
+		t.Run(zt.Name, func(t *testing.T) {
+			path := filepath.Join("testdata", zt.Name)
+			full, err := Open(SourceFromFile(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compact, err := OpenWithOptions(SourceFromFile(path), &Options{Compact: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compact.File != nil {
+				t.Fatal("compact reader populated File")
+			}
+			if compact.NumFiles() != len(full.File) {
+				t.Fatalf("file count=%d, want %d", compact.NumFiles(), len(full.File))
+			}
+			for i, want := range full.File {
+				got := compact.FileAt(i)
+				wantHeader := want.FileHeader
+				wantHeader.Extra = nil
+				if fmt.Sprint(got.FileHeader) != fmt.Sprint(wantHeader) {
+					t.Errorf("entry %d:\n got %+v\nwant %+v", i, got.FileHeader, wantHeader)
+				}
+				if !equalTimeAndZone(got.Modified, want.Modified) {
+					t.Errorf("%s: Modified=%s, want %s", got.Name, got.Modified, want.Modified)
+				}
+				if got.UID != want.UID || got.GID != want.GID ||
+					!got.AccessTime.Equal(want.AccessTime) || !got.CreationTime.Equal(want.CreationTime) {
+					t.Errorf("%s: got owner %d:%d and times %v, %v, want %d:%d and %v, %v", got.Name,
+						got.UID, got.GID, got.AccessTime, got.CreationTime,
+						want.UID, want.GID, want.AccessTime, want.CreationTime)
+				}
+				if got.headerOffset != want.headerOffset {
+					t.Errorf("%s: headerOffset=%d, want %d", got.Name, got.headerOffset, want.headerOffset)
+				}
+			}
+			for i, ft := range zt.File {
+				readTestFile(t, zt, ft, compact.FileAt(i))
+			}
+		})
+	}
+}
+
+func TestCompactLookup(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, name := range []string{"b/c.txt", "a.txt", "dir/", "b/a.txt", "./odd.txt"} {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		if _, err := io.WriteString(fw, "contents of "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := OpenWithOptions(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())), &Options{Compact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		content string
+		err     bool
+	}{
+		{name: "a.txt", content: "contents of a.txt"},
+		{name: "b/a.txt", content: "contents of b/a.txt"},
+		{name: "b/c.txt", content: "contents of b/c.txt"},
+		{name: "odd.txt", content: "contents of ./odd.txt"},
+		{name: "b", err: true},
+		{name: "dir", err: true},
+		{name: ".", err: true},
+		{name: "missing", err: true},
+		{name: "../a.txt", err: true},
+	} {
+		f, err := z.OpenLookup(test.name)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.content {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.content)
+		}
+	}
+
+	if err := fstest.TestFS(z, "a.txt", "b/a.txt", "b/c.txt", "dir", "odd.txt"); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkReaderIndex(b *testing.B) {
+	const entries = 100000
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for i := 0; i < entries; i++ {
+		_, err := w.CreateHeader(&FileHeader{
+			Name:   fmt.Sprintf("assets/dir%03d/file%06d.txt", i%1000, i),
+			Method: Store,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, compact := range []bool{false, true} {
+		name := "full"
+		if compact {
+			name = "compact"
+		}
+		b.Run(name, func(b *testing.B) {
+			var z *Reader
+			var before, after runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				z = nil
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				var err error
+				z, err = OpenWithOptions(SourceFromReaderAt(bytes.NewReader(data), int64(len(data))), &Options{Compact: compact})
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Resolve a name so the lookup structures are built in both modes.
+				if _, err := z.OpenLookup("assets/dir000/file000000.txt"); err != nil {
+					b.Fatal(err)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+			}
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/entries, "heap-bytes/entry")
+			runtime.KeepAlive(z)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package zipread
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/fs"
+)
+
+// digestSHA256 identifies SHA-256 in the digest extra field, which holds
+// the algorithm followed by the digest of the uncompressed content.
+const digestSHA256 = 1
+
+// DigestExtra returns an extra field recording sum as the SHA-256 digest
+// of an entry's uncompressed content. Since the digest is usually known
+// only after the content is written, the field can be added to the
+// FileHeader after writing, in which case only the central directory
+// holds it.
+func DigestExtra(sum []byte) []byte {
+	buf := make([]byte, 5+len(sum))
+	b := writeBuf(buf)
+	b.uint16(digestExtraID)
+	b.uint16(uint16(1 + len(sum)))
+	b.uint8(digestSHA256)
+	copy(b, sum)
+	return buf
+}
+
+// Digest returns the SHA-256 digest of the uncompressed content recorded
+// for f, or nil if there is none.
+func (f *File) Digest() []byte {
+	return f.digest
+}
+
+// digestHash returns the hash to verify f's content with, if any.
+func (f *File) digestHash() hash.Hash {
+	if f.zip == nil || !f.zip.verifyDigests || f.digest == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+// LookupDigest returns the first entry whose recorded SHA-256 digest is
+// sum. The index of digests is built on first use.
+func (z *Reader) LookupDigest(sum []byte) (*File, error) {
+	z.digestsOnce.Do(func() {
+		z.digests = make(map[[sha256.Size]byte]int)
+		for i, n := 0, z.NumFiles(); i < n; i++ {
+			var key [sha256.Size]byte
+			if d := z.FileAt(i).Digest(); len(d) == len(key) {
+				copy(key[:], d)
+				if _, ok := z.digests[key]; !ok {
+					z.digests[key] = i
+				}
+			}
+		}
+	})
+	var key [sha256.Size]byte
+	if len(sum) == len(key) {
+		copy(key[:], sum)
+		if i, ok := z.digests[key]; ok {
+			return z.FileAt(i), nil
+		}
+	}
+	return nil, &fs.PathError{Op: "lookup", Path: hex.EncodeToString(sum), Err: fs.ErrNotExist}
+}
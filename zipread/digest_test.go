@@ -0,0 +1,104 @@
+package zipread
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	contents := map[string]string{
+		"good.txt": "good content",
+		"bad.txt":  "bad content",
+		"none.txt": "no digest",
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, name := range []string{"good.txt", "bad.txt", "none.txt"} {
+		fh := &FileHeader{Name: name, Method: Deflate}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fw, contents[name]); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.CloseEntry(); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(contents[name]))
+		switch name {
+		case "bad.txt":
+			sum[0] ^= 1
+			fallthrough
+		case "good.txt":
+			fh.Extra = append(fh.Extra, DigestExtra(sum[:])...)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(f *File) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rc.Close() }()
+		_, err = io.Copy(io.Discard, rc)
+		return err
+	}
+
+	for _, compact := range []bool{false, true} {
+		source := SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		z, err := OpenWithOptions(source, &Options{Compact: compact, VerifyDigests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		good := sha256.Sum256([]byte(contents["good.txt"]))
+		for i := 0; i < z.NumFiles(); i++ {
+			f := z.FileAt(i)
+			err := read(f)
+			switch f.Name {
+			case "good.txt":
+				if !bytes.Equal(f.Digest(), good[:]) {
+					t.Errorf("compact=%v: digest %x, want %x", compact, f.Digest(), good)
+				}
+				if err != nil {
+					t.Errorf("compact=%v: %s: %v", compact, f.Name, err)
+				}
+			case "bad.txt":
+				if !errors.Is(err, ErrDigest) {
+					t.Errorf("compact=%v: %s: got %v, want ErrDigest", compact, f.Name, err)
+				}
+			case "none.txt":
+				if f.Digest() != nil || err != nil {
+					t.Errorf("compact=%v: %s: digest %x, err %v", compact, f.Name, f.Digest(), err)
+				}
+			}
+		}
+
+		f, err := z.LookupDigest(good[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name != "good.txt" {
+			t.Errorf("compact=%v: LookupDigest found %s", compact, f.Name)
+		}
+		missing := sha256.Sum256(nil)
+		if _, err := z.LookupDigest(missing[:]); err == nil {
+			t.Errorf("compact=%v: LookupDigest found missing digest", compact)
+		}
+	}
+
+	// Without VerifyDigests, mismatched digests are not noticed.
+	z, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read(z.File[1]); err != nil {
+		t.Errorf("%s: %v", z.File[1].Name, err)
+	}
+}
@@ -0,0 +1,190 @@
+package zipread
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/zeebo/errs/v2"
+)
+
+// limitedSource caps the number of upstream requests in flight and
+// coalesces concurrent requests for the same data.
+type limitedSource struct {
+	s   Source
+	sem chan struct{}
+
+	mu      sync.Mutex
+	flights []*flight
+}
+
+// flight is a single upstream fetch that any number of callers may
+// be waiting on.
+type flight struct {
+	fromEnd        bool
+	offset, length int64 // offset is unused for fromEnd flights
+
+	done chan struct{}
+	data []byte
+	size int64 // source length, only set for fromEnd flights
+	err  error
+}
+
+// LimitSource wraps s so that at most limit requests are issued to s at
+// the same time. Concurrent requests whose range is identical to, or fully
+// contained in, a request that is already in flight do not cause another
+// upstream request; they wait for the in-flight one and are served from its
+// result.
+//
+// To be shareable, every range is read completely into memory before it is
+// returned, so LimitSource is best suited to the small and medium sized
+// ranges used for headers, directories and typical entries.
+// A limit less than 1 means no limit on concurrency.
+func LimitSource(s Source, limit int) Source {
+	ls := &limitedSource{s: s}
+	if limit > 0 {
+		ls.sem = make(chan struct{}, limit)
+	}
+	return ls
+}
+
+func (s *limitedSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, errs.Errorf("negative argument")
+	}
+	for {
+		f, leader := s.join(false, offset, length)
+		if leader {
+			s.fetch(ctx, f)
+		}
+		data, _, err := s.wait(ctx, f, leader)
+		if retry(ctx, err, leader) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		start := offset - f.offset
+		if start > int64(len(data)) {
+			start = int64(len(data))
+		}
+		data = data[start:]
+		if int64(len(data)) > length {
+			data = data[:length]
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func (s *limitedSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	if length < 0 {
+		return nil, 0, errs.Errorf("negative argument")
+	}
+	for {
+		f, leader := s.join(true, 0, length)
+		if leader {
+			s.fetch(ctx, f)
+		}
+		data, size, err := s.wait(ctx, f, leader)
+		if retry(ctx, err, leader) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if int64(len(data)) > length {
+			data = data[int64(len(data))-length:]
+		}
+		return io.NopCloser(bytes.NewReader(data)), size, nil
+	}
+}
+
+// join finds an in-flight request covering the given range, or registers
+// a new one. leader is true if the caller is responsible for the fetch.
+func (s *limitedSource) join(fromEnd bool, offset, length int64) (f *flight, leader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.flights {
+		if f.fromEnd != fromEnd {
+			continue
+		}
+		if fromEnd && length <= f.length {
+			return f, false
+		}
+		if !fromEnd && offset >= f.offset && offset+length <= f.offset+f.length {
+			return f, false
+		}
+	}
+	f = &flight{
+		fromEnd: fromEnd,
+		offset:  offset,
+		length:  length,
+		done:    make(chan struct{}),
+	}
+	s.flights = append(s.flights, f)
+	return f, true
+}
+
+// fetch performs the upstream request for f and wakes up any waiters.
+func (s *limitedSource) fetch(ctx context.Context, f *flight) {
+	defer func() {
+		s.mu.Lock()
+		for i, other := range s.flights {
+			if other == f {
+				s.flights = append(s.flights[:i], s.flights[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		close(f.done)
+	}()
+
+	if err := ctx.Err(); err != nil {
+		f.err = err
+		return
+	}
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+			defer func() { <-s.sem }()
+		case <-ctx.Done():
+			f.err = ctx.Err()
+			return
+		}
+	}
+
+	var rc io.ReadCloser
+	if f.fromEnd {
+		rc, f.size, f.err = s.s.RangeFromEnd(ctx, f.length)
+	} else {
+		rc, f.err = s.s.Range(ctx, f.offset, f.length)
+	}
+	if f.err != nil {
+		return
+	}
+	f.data, f.err = io.ReadAll(rc)
+	f.err = errs.Combine(f.err, rc.Close())
+}
+
+// wait blocks until f is done or ctx is canceled.
+func (s *limitedSource) wait(ctx context.Context, f *flight, leader bool) ([]byte, int64, error) {
+	if !leader {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	return f.data, f.size, f.err
+}
+
+// retry reports whether a waiter should issue its own request because the
+// shared one failed only due to the leader's context going away.
+func retry(ctx context.Context, err error, leader bool) bool {
+	if leader || err == nil || ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
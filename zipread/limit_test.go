@@ -0,0 +1,209 @@
+package zipread
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedSource counts upstream requests and holds them until released.
+type gatedSource struct {
+	Source
+	release chan struct{}
+
+	calls    int32
+	inflight int32
+	maxSeen  int32
+}
+
+func (s *gatedSource) enter() {
+	atomic.AddInt32(&s.calls, 1)
+	n := atomic.AddInt32(&s.inflight, 1)
+	for {
+		m := atomic.LoadInt32(&s.maxSeen)
+		if n <= m || atomic.CompareAndSwapInt32(&s.maxSeen, m, n) {
+			break
+		}
+	}
+	<-s.release
+	atomic.AddInt32(&s.inflight, -1)
+}
+
+func (s *gatedSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	s.enter()
+	return s.Source.Range(ctx, offset, length)
+}
+
+func (s *gatedSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	s.enter()
+	return s.Source.RangeFromEnd(ctx, length)
+}
+
+func newGatedSource(data []byte) *gatedSource {
+	return &gatedSource{
+		Source:  SourceFromReaderAt(bytes.NewReader(data), int64(len(data))),
+		release: make(chan struct{}),
+	}
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestLimitSourceCoalesces(t *testing.T) {
+	data := testData(4096)
+	gs := newGatedSource(data)
+	s := LimitSource(gs, 4)
+
+	// Start the covering request first so the others can join it.
+	started := make(chan struct{})
+	var leaderErr error
+	var leaderData []byte
+	go func() {
+		defer close(started)
+		rc, err := s.Range(context.Background(), 100, 1000)
+		if err != nil {
+			leaderErr = err
+			return
+		}
+		leaderData, leaderErr = io.ReadAll(rc)
+	}()
+	for atomic.LoadInt32(&gs.inflight) == 0 {
+		runtime.Gosched() // wait for the leader to reach the upstream source
+	}
+
+	const waiters = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset := int64(100 + i)
+			rc, err := s.Range(context.Background(), offset, 500)
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data[offset:offset+500]) {
+				t.Errorf("waiter %d: wrong data", i)
+			}
+		}()
+	}
+
+	// Give the waiters a chance to join the in-flight request.
+	time.Sleep(100 * time.Millisecond)
+	close(gs.release)
+	wg.Wait()
+	<-started
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if leaderErr != nil {
+		t.Fatal(leaderErr)
+	}
+	if !bytes.Equal(leaderData, data[100:1100]) {
+		t.Fatal("leader: wrong data")
+	}
+	// Waiters that arrived after the leader finished may have issued
+	// their own request, but most of them must have been coalesced.
+	if calls := atomic.LoadInt32(&gs.calls); calls > waiters/2 {
+		t.Fatalf("got %d upstream calls, expected coalescing", calls)
+	}
+}
+
+func TestLimitSourceFromEnd(t *testing.T) {
+	data := testData(4096)
+	gs := newGatedSource(data)
+	close(gs.release)
+	s := LimitSource(gs, 1)
+
+	rc, size, err := s.RangeFromEnd(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("got size %d, want %d", size, len(data))
+	}
+	if !bytes.Equal(got, data[len(data)-100:]) {
+		t.Fatal("wrong data")
+	}
+}
+
+func TestLimitSourceCapsConcurrency(t *testing.T) {
+	data := testData(4096)
+	gs := newGatedSource(data)
+	s := LimitSource(gs, 3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Disjoint ranges, so nothing can be coalesced.
+			rc, err := s.Range(context.Background(), int64(i*100), 50)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = io.ReadAll(rc)
+		}()
+	}
+	for atomic.LoadInt32(&gs.inflight) < 3 {
+		runtime.Gosched() // wait for the limit to be reached
+	}
+	close(gs.release)
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&gs.maxSeen); max > 3 {
+		t.Fatalf("saw %d concurrent upstream requests, limit was 3", max)
+	}
+	if calls := atomic.LoadInt32(&gs.calls); calls != 20 {
+		t.Fatalf("got %d upstream calls, want 20", calls)
+	}
+}
+
+func TestLimitSourceCanceledLeader(t *testing.T) {
+	data := testData(4096)
+	gs := newGatedSource(data)
+	close(gs.release)
+	s := LimitSource(gs, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Range(ctx, 0, 10); err == nil {
+		t.Fatal("expected error from canceled context")
+	}
+	rc, err := s.Range(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:10]) {
+		t.Fatal("wrong data")
+	}
+}
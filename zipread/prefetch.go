@@ -4,17 +4,79 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"os"
 
 	"github.com/zeebo/errs/v2"
 )
 
+// PrefetchOptions controls how PrefetchTailWithOptions stores the tail.
+type PrefetchOptions struct {
+	// MaxPrefetch caps how many bytes are fetched up front. Anything
+	// before the prefetched tail is read from the underlying Source on
+	// demand. Zero means no cap.
+	MaxPrefetch int64
+
+	// SpillThreshold, if positive, makes tails larger than this many bytes
+	// be stored in a temporary file instead of in memory.
+	SpillThreshold int64
+
+	// TempDir is the directory spilled tails are written to. If empty,
+	// os.TempDir is used.
+	TempDir string
+}
+
 type prefetchedTailSource struct {
 	s            Source
 	size, offset int64
-	tail         []byte
+	tail         tailData
+}
+
+// tailData holds the prefetched bytes, either in memory or on disk.
+type tailData interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type memoryTail []byte
+
+func (t memoryTail) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(t).ReadAt(p, off)
 }
 
+func (t memoryTail) Close() error { return nil }
+
+type fileTail struct {
+	fh   *os.File
+	name string // set if the file still needs to be removed on Close
+}
+
+func (t *fileTail) ReadAt(p []byte, off int64) (int, error) { return t.fh.ReadAt(p, off) }
+
+func (t *fileTail) Close() error {
+	err := t.fh.Close()
+	if t.name != "" {
+		err = errs.Combine(err, os.Remove(t.name))
+	}
+	return err
+}
+
+// PrefetchTail returns a Source that serves the last amount bytes of s
+// from memory, fetching them with a single request up front.
 func PrefetchTail(ctx context.Context, s Source, amount int64) (Source, error) {
+	return PrefetchTailWithOptions(ctx, s, amount, nil)
+}
+
+// PrefetchTailWithOptions is like PrefetchTail, but allows capping the
+// prefetch and storing large tails in a temporary file. The returned Source
+// implements io.Closer, which should be called to release a spilled tail
+// once the Source is no longer used.
+func PrefetchTailWithOptions(ctx context.Context, s Source, amount int64, opts *PrefetchOptions) (_ Source, err error) {
+	if opts == nil {
+		opts = &PrefetchOptions{}
+	}
+	if opts.MaxPrefetch > 0 && amount > opts.MaxPrefetch {
+		amount = opts.MaxPrefetch
+	}
 	rc, size, err := s.RangeFromEnd(ctx, amount)
 	if err != nil {
 		return nil, err
@@ -22,17 +84,53 @@ func PrefetchTail(ctx context.Context, s Source, amount int64) (Source, error) {
 	if size < amount {
 		amount = size
 	}
-	tail := make([]byte, amount)
-	_, err = io.ReadFull(rc, tail)
-	if err != nil {
-		return nil, errs.Combine(err, rc.Close())
+
+	var tail tailData
+	if opts.SpillThreshold > 0 && amount > opts.SpillThreshold {
+		var ft *fileTail
+		ft, err = spillTail(rc, amount, opts.TempDir)
+		if err == nil {
+			tail = ft
+		}
+	} else {
+		buf := make([]byte, amount)
+		_, err = io.ReadFull(rc, buf)
+		tail = memoryTail(buf)
+	}
+	if err := errs.Combine(err, rc.Close()); err != nil {
+		// A spilled tail must not outlive a failed prefetch.
+		if tail != nil {
+			err = errs.Combine(err, tail.Close())
+		}
+		return nil, err
 	}
 	return &prefetchedTailSource{
 		s:      s,
 		size:   size,
 		offset: size - amount,
 		tail:   tail,
-	}, rc.Close()
+	}, nil
+}
+
+func spillTail(r io.Reader, amount int64, dir string) (_ *fileTail, err error) {
+	fh, err := os.CreateTemp(dir, "zipread-tail-*")
+	if err != nil {
+		return nil, err
+	}
+	t := &fileTail{fh: fh}
+	// Unlinking an open file is not possible everywhere, in which case
+	// the file is removed on Close instead.
+	if os.Remove(fh.Name()) != nil {
+		t.name = fh.Name()
+	}
+	n, err := io.Copy(fh, io.LimitReader(r, amount))
+	if err == nil && n != amount {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, errs.Combine(err, t.Close())
+	}
+	return t, nil
 }
 
 func (s *prefetchedTailSource) Range(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
@@ -47,7 +145,7 @@ func (s *prefetchedTailSource) Range(ctx context.Context, offset, length int64)
 	}
 
 	if offset >= s.offset {
-		return io.NopCloser(bytes.NewReader(s.tail[offset-s.offset:][:length])), nil
+		return io.NopCloser(io.NewSectionReader(s.tail, offset-s.offset, length)), nil
 	}
 
 	if offset+length <= s.offset {
@@ -63,7 +161,7 @@ func (s *prefetchedTailSource) Range(ctx context.Context, offset, length int64)
 		io.Reader
 		io.Closer
 	}{
-		Reader: io.MultiReader(unfetched, bytes.NewReader(s.tail[:offset+length-s.offset])),
+		Reader: io.MultiReader(unfetched, io.NewSectionReader(s.tail, 0, offset+length-s.offset)),
 		Closer: unfetched,
 	}, nil
 }
@@ -75,3 +173,8 @@ func (s *prefetchedTailSource) RangeFromEnd(ctx context.Context, length int64) (
 	rc, err = s.Range(ctx, s.size-length, length)
 	return rc, s.size, err
 }
+
+// Close releases the prefetched tail.
+func (s *prefetchedTailSource) Close() error {
+	return s.tail.Close()
+}
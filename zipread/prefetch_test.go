@@ -0,0 +1,131 @@
+package zipread
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestPrefetchTailWithOptions(t *testing.T) {
+	data := testData(10000)
+	for _, test := range []struct {
+		name string
+		opts PrefetchOptions
+	}{
+		{"memory", PrefetchOptions{}},
+		{"spill", PrefetchOptions{SpillThreshold: 100, TempDir: t.TempDir()}},
+		{"capped", PrefetchOptions{MaxPrefetch: 500}},
+		{"capped-spill", PrefetchOptions{MaxPrefetch: 500, SpillThreshold: 100, TempDir: t.TempDir()}},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			gs := newGatedSource(data)
+			close(gs.release)
+			s, err := PrefetchTailWithOptions(context.Background(), gs, 2000, &test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := s.(io.Closer).Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			if gs.calls != 1 {
+				t.Fatalf("got %d upstream calls, want 1", gs.calls)
+			}
+
+			for _, r := range []struct{ offset, length int64 }{
+				{9990, 10}, {9000, 1000}, {7000, 2000}, {0, 10}, {7900, 200}, {9995, 100},
+			} {
+				rc, err := s.Range(context.Background(), r.offset, r.length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := rc.Close(); err != nil {
+					t.Fatal(err)
+				}
+				end := r.offset + r.length
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				if !bytes.Equal(got, data[r.offset:end]) {
+					t.Fatalf("range %d+%d: wrong data", r.offset, r.length)
+				}
+			}
+
+			tail := int64(2000)
+			if test.opts.MaxPrefetch > 0 {
+				tail = test.opts.MaxPrefetch
+			}
+			before := gs.calls
+			rc, _, err := s.RangeFromEnd(context.Background(), tail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = rc.Close()
+			if gs.calls != before {
+				t.Fatal("prefetched tail was fetched again")
+			}
+		})
+	}
+}
+
+func TestPrefetchTailSpilledZip(t *testing.T) {
+	s, err := PrefetchTailWithOptions(context.Background(), SourceFromFile("testdata/test.zip"), 1<<20,
+		&PrefetchOptions{SpillThreshold: 1, TempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.(io.Closer).Close() }()
+	z, err := Open(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zt := tests[0]
+	if len(z.File) != len(zt.File) {
+		t.Fatalf("file count=%d, want %d", len(z.File), len(zt.File))
+	}
+	for i, ft := range zt.File {
+		readTestFile(t, zt, ft, z.File[i])
+	}
+}
+
+// failingCloseSource returns ranges whose Close fails.
+type failingCloseSource struct{ Source }
+
+type failingCloser struct{ io.Reader }
+
+func (failingCloser) Close() error { return errors.New("close failed") }
+
+func (s failingCloseSource) RangeFromEnd(ctx context.Context, length int64) (io.ReadCloser, int64, error) {
+	rc, size, err := s.Source.RangeFromEnd(ctx, length)
+	if err != nil {
+		return nil, 0, err
+	}
+	return failingCloser{rc}, size, rc.Close()
+}
+
+func TestPrefetchTailCloseError(t *testing.T) {
+	data := testData(10000)
+	dir := t.TempDir()
+	s := failingCloseSource{SourceFromReaderAt(bytes.NewReader(data), int64(len(data)))}
+	_, err := PrefetchTailWithOptions(context.Background(), s, 2000,
+		&PrefetchOptions{SpillThreshold: 100, TempDir: dir})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("spilled tail was left behind: %v", entries)
+	}
+}
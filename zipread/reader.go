@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"hash"
@@ -30,6 +31,7 @@ var (
 	ErrFormat    = zip.ErrFormat
 	ErrAlgorithm = zip.ErrAlgorithm
 	ErrChecksum  = zip.ErrChecksum
+	ErrDigest    = errors.New("zip: digest error")
 )
 
 // A Reader serves content from a ZIP archive.
@@ -37,10 +39,27 @@ type Reader struct {
 	source Source
 	size   int64
 
+	// dirOffset and dirSize locate the central directory.
+	dirOffset, dirSize int64
+
 	File          []*File
 	Comment       string
 	decompressors map[uint16]Decompressor
 
+	// compact holds the directory instead of File when the Reader
+	// was opened with Options.Compact.
+	compact *compactIndex
+
+	// sharedHeaders holds the local header offsets of more than one
+	// entry, as written by Writer.AppendDuplicate.
+	sharedHeaders map[int64]bool
+
+	verifyDigests bool
+
+	// digests maps recorded digests to entry indexes, for LookupDigest.
+	digestsOnce sync.Once
+	digests     map[[sha256.Size]byte]int
+
 	// fileList is a list of files sorted by ename,
 	// for use by the Open method.
 	fileListOnce sync.Once
@@ -52,14 +71,54 @@ type Reader struct {
 // The file content can be accessed by calling Open.
 type File struct {
 	FileHeader
+
+	// UID and GID are the owner recorded in an Info-ZIP Unix extra
+	// field, if any.
+	UID, GID int
+
+	// AccessTime and CreationTime are recorded in the extended
+	// timestamp extra field, if any.
+	AccessTime   time.Time
+	CreationTime time.Time
+
+	digest []byte // SHA-256 recorded in the digest extra field, if any
+
 	zip          *Reader
 	zips         Source
 	zipsize      int64
 	headerOffset int64
 }
 
+// Options configures OpenWithOptions.
+type Options struct {
+	// Compact keeps the central directory in a compact form instead of
+	// as a *File per entry, which greatly reduces memory use for archives
+	// with many entries. Reader.File is left empty; entries are accessed
+	// with NumFiles, FileAt and OpenLookup, which build a *File on demand.
+	// Such Files carry no Extra data, but keep everything parsed from it:
+	// the owner, times and digest. Using the Reader as an fs.FS builds the
+	// full file list on first use.
+	Compact bool
+
+	// VerifyDigests makes File.Open check the SHA-256 digest recorded for
+	// an entry, if any, once its content has been read to EOF, returning
+	// ErrDigest on a mismatch.
+	VerifyDigests bool
+}
+
 func Open(source Source) (*Reader, error) {
-	zr := &Reader{}
+	return OpenWithOptions(source, nil)
+}
+
+// OpenWithOptions is like Open, but allows configuring the Reader.
+func OpenWithOptions(source Source, opts *Options) (*Reader, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	zr := &Reader{verifyDigests: opts.VerifyDigests}
+	if opts.Compact {
+		zr.compact = &compactIndex{}
+	}
 	if err := zr.init(source); err != nil {
 		return nil, err
 	}
@@ -73,8 +132,13 @@ func (z *Reader) init(source Source) (err error) {
 	}
 	z.source = source
 	z.size = size
-	z.File = make([]*File, 0, end.directoryRecords)
+	if z.compact == nil {
+		z.File = make([]*File, 0, end.directoryRecords)
+	} else {
+		z.compact.grow(end.directoryRecords)
+	}
 	z.Comment = end.comment
+	z.dirOffset, z.dirSize = int64(end.directoryOffset), int64(end.directorySize)
 	rs, err := source.Range(context.TODO(), int64(end.directoryOffset), size-int64(end.directoryOffset))
 	if err != nil {
 		return err
@@ -95,10 +159,18 @@ func (z *Reader) init(source Source) (err error) {
 		if err != nil {
 			return err
 		}
+		if z.compact != nil {
+			z.compact.add(f)
+			continue
+		}
 		z.File = append(z.File, f)
 	}
+	if z.compact != nil {
+		z.compact.index()
+	}
+	z.findSharedHeaders()
 
-	if uint16(len(z.File)) != uint16(end.directoryRecords) { // only compare 16 bits here
+	if uint16(z.NumFiles()) != uint16(end.directoryRecords) { // only compare 16 bits here
 		// Return the readDirectoryHeader error if we read
 		// the wrong number of directory entries.
 		return err
@@ -106,6 +178,38 @@ func (z *Reader) init(source Source) (err error) {
 	return nil
 }
 
+// findSharedHeaders records the local header offsets used by more than one
+// entry.
+func (z *Reader) findSharedHeaders() {
+	var offsets []int64
+	if z.compact != nil {
+		offsets = make([]int64, 0, len(z.compact.records))
+		for i := range z.compact.records {
+			offsets = append(offsets, z.compact.records[i].headerOffset)
+		}
+	} else {
+		offsets = make([]int64, 0, len(z.File))
+		for _, f := range z.File {
+			offsets = append(offsets, f.headerOffset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] == offsets[i-1] {
+			if z.sharedHeaders == nil {
+				z.sharedHeaders = make(map[int64]bool)
+			}
+			z.sharedHeaders[offsets[i]] = true
+		}
+	}
+}
+
+// Directory returns the offset and size of the archive's central directory,
+// as recorded in its end of central directory record.
+func (z *Reader) Directory() (offset, size int64) {
+	return z.dirOffset, z.dirSize
+}
+
 // RegisterDecompressor registers or overrides a custom decompressor for a
 // specific method ID. If a decompressor for a given method is not found,
 // Reader will default to looking up the decompressor at the package level.
@@ -131,13 +235,61 @@ func (f closerFunc) Close() error { return f() }
 // Open returns a ReadCloser that provides access to the File's contents.
 // Multiple files may be read concurrently.
 func (f *File) Open() (io.ReadCloser, error) {
-	size := int64(f.CompressedSize64)
-
 	dcomp := f.zip.decompressor(f.Method)
 	if dcomp == nil {
 		return nil, ErrAlgorithm
 	}
 
+	data, rr, err := f.openBody()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := dcomp(data)
+
+	return &checksumReader{
+		rc: struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: rc,
+			Closer: closerFunc(func() error {
+				err1 := rc.Close()
+				return errs.Combine(err1, rr.Close())
+			}),
+		},
+		hash:   crc32.NewIEEE(),
+		digest: f.digestHash(),
+		f:      f,
+	}, nil
+}
+
+// OpenRaw returns a ReadCloser that provides access to the File's contents
+// without decompressing them. No checksum is verified; the CRC-32 and sizes
+// in the FileHeader describe the data once decompressed.
+func (f *File) OpenRaw() (io.ReadCloser, error) {
+	data, rr, err := f.openBody()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: data,
+		Closer: rr,
+	}, nil
+}
+
+// worstCaseExtra is how much more than a local header with f.Name and no
+// extra field is requested along with an entry's contents.
+const worstCaseExtra = math.MaxUint16 // 64 KB
+
+// openBody returns a reader for the compressed contents of f, along with
+// the range reader that has to be closed when done.
+func (f *File) openBody() (io.Reader, io.ReadCloser, error) {
+	size := int64(f.CompressedSize64)
+
 	// This sucks. The zip central directory entry doesn't have
 	// enough information to actually figure out the exact body offset,
 	// specifically due to the Extra field, which apparently does not
@@ -148,29 +300,44 @@ func (f *File) Open() (io.ReadCloser, error) {
 	// second thing since round trips are the worse outcome.
 	// This is one of the areas where ZIPs don't make a good
 	// remote pack format.
-	const worstCaseExtra = math.MaxUint16 // 64 KB
 
 	rr, err := f.zips.Range(context.TODO(), f.headerOffset, size+fileHeaderLen+int64(len(f.Name))+worstCaseExtra)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	data := bufio.NewReader(rr)
 	err = f.validateFileHeader(data)
 	if err != nil {
-		return nil, errs.Combine(err, rr.Close())
+		return nil, nil, errs.Combine(err, rr.Close())
 	}
 
-	rc := dcomp(io.LimitReader(data, size))
+	return io.LimitReader(data, size), rr, nil
+}
 
+// NewEntryReader returns a ReadCloser that decompresses the raw content of a
+// single entry read from rc, using the given method. The uncompressed size and
+// CRC-32 are verified once the content has been read to EOF, as with File.Open.
+// Closing the returned ReadCloser closes rc.
+func NewEntryReader(rc io.ReadCloser, method uint16, crc uint32, size uint64) (io.ReadCloser, error) {
+	dcomp := decompressor(method)
+	if dcomp == nil {
+		return nil, ErrAlgorithm
+	}
+	dr := dcomp(rc)
+	f := &File{FileHeader: FileHeader{
+		Method:             method,
+		CRC32:              crc,
+		UncompressedSize64: size,
+	}}
 	return &checksumReader{
 		rc: struct {
 			io.Reader
 			io.Closer
 		}{
-			Reader: rc,
+			Reader: dr,
 			Closer: closerFunc(func() error {
-				err1 := rc.Close()
-				return errs.Combine(err1, rr.Close())
+				err1 := dr.Close()
+				return errs.Combine(err1, rc.Close())
 			}),
 		},
 		hash: crc32.NewIEEE(),
@@ -186,7 +353,6 @@ func (f *File) OpenAsGzip() (io.ReadCloser, error) {
 	if f.Method != Deflate {
 		return nil, ErrAlgorithm
 	}
-	const worstCaseExtra = math.MaxUint16 // 64 KB
 	rr, err := f.zips.Range(context.TODO(), f.headerOffset, size+fileHeaderLen+int64(len(f.Name))+worstCaseExtra)
 	if err != nil {
 		return nil, err
@@ -217,12 +383,13 @@ func GzipWrapper(r io.Reader, digest, decompressedSize uint32) io.Reader {
 }
 
 type checksumReader struct {
-	rc    io.ReadCloser
-	hash  hash.Hash32
-	nread uint64 // number of bytes read so far
-	f     *File
-	desr  io.Reader // if non-nil, where to read the data descriptor
-	err   error     // sticky error
+	rc     io.ReadCloser
+	hash   hash.Hash32
+	digest hash.Hash // if non-nil, checked against the recorded digest
+	nread  uint64    // number of bytes read so far
+	f      *File
+	desr   io.Reader // if non-nil, where to read the data descriptor
+	err    error     // sticky error
 }
 
 func (r *checksumReader) Stat() (fs.FileInfo, error) {
@@ -235,6 +402,9 @@ func (r *checksumReader) Read(b []byte) (n int, err error) {
 	}
 	n, err = r.rc.Read(b)
 	r.hash.Write(b[:n])
+	if r.digest != nil {
+		r.digest.Write(b[:n])
+	}
 	r.nread += uint64(n)
 	if err == nil {
 		return
@@ -249,6 +419,8 @@ func (r *checksumReader) Read(b []byte) (n int, err error) {
 		// like it was set.
 		if r.f.CRC32 != 0 && r.hash.Sum32() != r.f.CRC32 {
 			err = ErrChecksum
+		} else if r.digest != nil && !bytes.Equal(r.digest.Sum(nil), r.f.digest) {
+			err = ErrDigest
 		}
 	}
 	r.err = err
@@ -260,7 +432,7 @@ func (r *checksumReader) Close() error { return r.rc.Close() }
 // validateFileHeader reads off the header, fast-forwarding data to
 // start at the content body.
 func (f *File) validateFileHeader(data io.Reader) (err error) {
-	buf := make([]byte, fileHeaderLen+len(f.Name))
+	var buf [fileHeaderLen]byte
 	if _, err = io.ReadFull(data, buf[:]); err != nil {
 		return err
 	}
@@ -272,10 +444,16 @@ func (f *File) validateFileHeader(data io.Reader) (err error) {
 	b = b[22:] // skip over most of the header
 	filenameLen := int(b.uint16())
 	extraLen := int(b.uint16())
-	if filenameLen != len(f.Name) {
+	// The local name may only differ from f.Name if the local header is
+	// shared with other entries, as written by Writer.AppendDuplicate.
+	// The body has to be within what the callers requested, though.
+	if filenameLen != len(f.Name) && (f.zip == nil || !f.zip.sharedHeaders[f.headerOffset]) {
 		return ErrFormat
 	}
-	if _, err = io.ReadFull(data, make([]byte, extraLen)); err != nil {
+	if filenameLen+extraLen > len(f.Name)+worstCaseExtra {
+		return ErrFormat
+	}
+	if _, err = io.CopyN(ioutil.Discard, data, int64(filenameLen+extraLen)); err != nil {
 		return err
 	}
 	return nil
@@ -411,11 +589,40 @@ parseExtras:
 			ts := int64(fieldBuf.uint32()) // ModTime since Unix epoch
 			modified = time.Unix(ts, 0)
 		case extTimeExtraID:
-			if len(fieldBuf) < 5 || fieldBuf.uint8()&1 == 0 {
+			if len(fieldBuf) < 1 {
 				continue parseExtras
 			}
-			ts := int64(fieldBuf.uint32()) // ModTime since Unix epoch
-			modified = time.Unix(ts, 0)
+			// The flags say which times are present in the local header,
+			// but the central directory often only carries ModTime.
+			flags := fieldBuf.uint8()
+			if flags&1 != 0 && len(fieldBuf) >= 4 {
+				ts := int64(fieldBuf.uint32()) // ModTime since Unix epoch
+				modified = time.Unix(ts, 0)
+			}
+			if flags&2 != 0 && len(fieldBuf) >= 4 {
+				f.AccessTime = time.Unix(int64(fieldBuf.uint32()), 0).UTC()
+			}
+			if flags&4 != 0 && len(fieldBuf) >= 4 {
+				f.CreationTime = time.Unix(int64(fieldBuf.uint32()), 0).UTC()
+			}
+		case digestExtraID:
+			if len(fieldBuf) != 1+sha256.Size || fieldBuf.uint8() != digestSHA256 {
+				continue parseExtras
+			}
+			f.digest = append([]byte(nil), fieldBuf...)
+		case unixOwnerExtraID:
+			if len(fieldBuf) < 1 || fieldBuf.uint8() != 1 { // version
+				continue parseExtras
+			}
+			uid, ok := fieldBuf.varUint()
+			if !ok {
+				continue parseExtras
+			}
+			gid, ok := fieldBuf.varUint()
+			if !ok {
+				continue parseExtras
+			}
+			f.UID, f.GID = int(uid), int(gid)
 		}
 	}
 
@@ -631,6 +838,24 @@ func (b *readBuf) uint64() uint64 {
 	return v
 }
 
+// varUint reads a little-endian integer prefixed by its size in bytes,
+// as used by the Info-ZIP Unix extra field.
+func (b *readBuf) varUint() (uint64, bool) {
+	if len(*b) < 1 {
+		return 0, false
+	}
+	size := int(b.uint8())
+	if size > 8 || len(*b) < size {
+		return 0, false
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64((*b)[i])
+	}
+	*b = (*b)[size:]
+	return v, true
+}
+
 func (b *readBuf) sub(n int) readBuf {
 	b2 := (*b)[:n]
 	*b = (*b)[n:]
@@ -687,11 +912,28 @@ func toValidName(name string) string {
 	return p
 }
 
+// NumFiles returns the number of entries in the archive.
+func (r *Reader) NumFiles() int {
+	if r.compact != nil {
+		return len(r.compact.records)
+	}
+	return len(r.File)
+}
+
+// FileAt returns the i'th entry of the archive, in directory order.
+func (r *Reader) FileAt(i int) *File {
+	if r.compact != nil {
+		return r.compact.file(r, i)
+	}
+	return r.File[i]
+}
+
 func (r *Reader) initFileList() {
 	r.fileListOnce.Do(func() {
 		dirs := make(map[string]bool)
 		knownDirs := make(map[string]bool)
-		for _, file := range r.File {
+		for i, n := 0, r.NumFiles(); i < n; i++ {
+			file := r.FileAt(i)
 			isDir := len(file.Name) > 0 && file.Name[len(file.Name)-1] == '/'
 			name := toValidName(file.Name)
 			for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
@@ -729,6 +971,12 @@ func fileEntryLess(x, y string) bool {
 }
 
 func (r *Reader) OpenLookup(name string) (*File, error) {
+	if r.compact != nil {
+		if !fs.ValidPath(name) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return r.compact.lookup(r, name)
+	}
 	r.initFileList()
 
 	e := r.openLookup(name)
@@ -741,6 +989,26 @@ func (r *Reader) OpenLookup(name string) (*File, error) {
 	return e.file, nil
 }
 
+// LookupDir returns the directory entry for name, which is given without
+// its trailing slash. Directories that are only implied by the names of
+// other entries have no entry of their own, and are reported as not
+// existing.
+func (r *Reader) LookupDir(name string) (*File, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if r.compact != nil {
+		return r.compact.lookupDir(r, name)
+	}
+	r.initFileList()
+
+	e := r.openLookup(name)
+	if e == nil || !e.isDir || e.file == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return e.file, nil
+}
+
 // Open opens the named file in the ZIP archive,
 // using the semantics of fs.FS.Open:
 // paths are always slash separated, with no
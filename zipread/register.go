@@ -7,10 +7,18 @@ package zipread
 import (
 	"compress/flate"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
 
+// A Compressor returns a new compressing writer, writing to w.
+// The WriteCloser's Close method must be used to flush pending data to w.
+// The Compressor itself must be safe to invoke from multiple goroutines
+// simultaneously, but each returned writer will be used only by
+// one goroutine at a time.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
 // A Decompressor returns a new decompressing reader, reading from r.
 // The ReadCloser's Close method must be used to release associated resources.
 // The Decompressor itself must be safe to invoke from multiple goroutines
@@ -18,6 +26,70 @@ import (
 // one goroutine at a time.
 type Decompressor func(r io.Reader) io.ReadCloser
 
+// defaultFlateLevel is the level used by the built in Deflate compressor.
+const defaultFlateLevel = 5
+
+// flateWriterPools holds a pool of writers for every flate level, from
+// flate.HuffmanOnly to flate.BestCompression.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func newFlateWriter(w io.Writer) io.WriteCloser {
+	fw, _ := newFlateWriterLevel(w, defaultFlateLevel)
+	return fw
+}
+
+func newFlateWriterLevel(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("zip: invalid compression level: %d", level)
+	}
+	pool := &flateWriterPools[level-flate.HuffmanOnly]
+	fw, ok := pool.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(w)
+	} else {
+		fw, _ = flate.NewWriter(w, level)
+	}
+	return &pooledFlateWriter{pool: pool, fw: fw}, nil
+}
+
+// DeflateCompressor returns a Compressor for the Deflate method using the
+// given flate level. Writers are pooled per level.
+func DeflateCompressor(level int) (Compressor, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("zip: invalid compression level: %d", level)
+	}
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return newFlateWriterLevel(w, level)
+	}, nil
+}
+
+type pooledFlateWriter struct {
+	mu   sync.Mutex // guards Close and Write
+	pool *sync.Pool
+	fw   *flate.Writer
+}
+
+func (w *pooledFlateWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fw == nil {
+		return 0, errors.New("Write after Close")
+	}
+	return w.fw.Write(p)
+}
+
+func (w *pooledFlateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	if w.fw != nil {
+		err = w.fw.Close()
+		w.pool.Put(w.fw)
+		w.fw = nil
+	}
+	return err
+}
+
 var flateReaderPool sync.Pool
 
 func newFlateReader(r io.Reader) io.ReadCloser {
@@ -57,10 +129,14 @@ func (r *pooledFlateReader) Close() error {
 }
 
 var (
+	compressors   sync.Map // map[uint16]Compressor
 	decompressors sync.Map // map[uint16]Decompressor
 )
 
 func init() {
+	compressors.Store(Store, Compressor(func(w io.Writer) (io.WriteCloser, error) { return &nopCloser{w}, nil }))
+	compressors.Store(Deflate, Compressor(func(w io.Writer) (io.WriteCloser, error) { return newFlateWriter(w), nil }))
+
 	decompressors.Store(Store, Decompressor(io.NopCloser))
 	decompressors.Store(Deflate, Decompressor(newFlateReader))
 }
@@ -73,6 +149,22 @@ func RegisterDecompressor(method uint16, dcomp Decompressor) {
 	}
 }
 
+// RegisterCompressor registers custom compressors for a specified method ID.
+// The common methods Store and Deflate are built in.
+func RegisterCompressor(method uint16, comp Compressor) {
+	if _, dup := compressors.LoadOrStore(method, comp); dup {
+		panic("compressor already registered")
+	}
+}
+
+func compressor(method uint16) Compressor {
+	ci, ok := compressors.Load(method)
+	if !ok {
+		return nil
+	}
+	return ci.(Compressor)
+}
+
 func decompressor(method uint16) Decompressor {
 	di, ok := decompressors.Load(method)
 	if !ok {
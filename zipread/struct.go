@@ -75,6 +75,8 @@ const (
 	unixExtraID        = 0x000d // UNIX
 	extTimeExtraID     = 0x5455 // Extended timestamp
 	infoZipUnixExtraID = 0x5855 // Info-ZIP Unix extension
+	unixOwnerExtraID   = 0x7875 // Info-ZIP new Unix extension (UID and GID)
+	digestExtraID      = 0x7a64 // content digest, specific to this package
 )
 
 type FileHeader = zip.FileHeader
@@ -5,14 +5,355 @@
 package zipread
 
 import (
-	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
-type Writer = zip.Writer
+var (
+	errLongName  = errors.New("zip: FileHeader.Name too long")
+	errLongExtra = errors.New("zip: FileHeader.Extra too long")
+)
+
+// Writer implements a zip file writer.
+type Writer struct {
+	cw          *countWriter
+	dir         []*header
+	last        *fileWriter
+	closed      bool
+	compressors map[uint16]Compressor
+	comment     string
+
+	// testHookCloseSizeOffset if non-nil is called with the size
+	// of offset of the central directory at Close.
+	testHookCloseSizeOffset func(size, offset uint64)
+}
+
+type header struct {
+	*FileHeader
+	offset        uint64
+	contentOffset uint64
+	raw           bool
+}
+
+// NewWriter returns a new Writer writing a zip file to w.
+//
+// Note that the exact bytes written to w are not covered by the Go 1
+// compatibility promise. Callers, including tests, should not depend on the
+// exact written bytes.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{cw: &countWriter{w: bufio.NewWriter(w)}}
+}
+
+// SetOffset sets the offset of the beginning of the zip data within the
+// underlying writer. It should be used when the zip data is appended to an
+// existing file, such as a binary executable.
+// It must be called before any data is written.
+func (w *Writer) SetOffset(n int64) {
+	if w.cw.count != 0 {
+		panic("zip: SetOffset called after data was written")
+	}
+	w.cw.count = n
+}
+
+// Flush flushes any buffered data to the underlying writer.
+// Calling Flush is not normally necessary; calling Close is sufficient.
+func (w *Writer) Flush() error {
+	return w.cw.w.(*bufio.Writer).Flush()
+}
+
+// CloseEntry finishes the file entry currently being written, if any,
+// without starting a new one. Afterwards, the entry's FileHeader holds
+// its final CRC32 and sizes. This is an addition to archive/zip, where
+// an entry is only finished by creating the next one or closing the Writer.
+func (w *Writer) CloseEntry() error {
+	if w.last != nil && !w.last.closed {
+		if err := w.last.close(); err != nil {
+			return err
+		}
+	}
+	w.last = nil
+	return nil
+}
+
+// NumEntries returns the number of entries created so far. This is an
+// addition to archive/zip, as are Entry, ContentOffset, AppendEntry and
+// AppendDuplicate.
+func (w *Writer) NumEntries() int {
+	return len(w.dir)
+}
+
+// Entry returns the header of the i'th entry created so far and the offset
+// of its local header. The CRC32 and sizes are only final once the entry
+// is finished.
+func (w *Writer) Entry(i int) (*FileHeader, int64) {
+	h := w.dir[i]
+	return h.FileHeader, int64(h.offset)
+}
+
+// ContentOffset returns the offset of the contents of the i'th entry
+// created so far, right after its local header.
+func (w *Writer) ContentOffset(i int) int64 {
+	return int64(w.dir[i].contentOffset)
+}
+
+// AppendEntry adds an entry whose local header and contents were already
+// written at offset and contentOffset, for example by an earlier Writer
+// whose output is continued with SetOffset, so that Close includes it in
+// the central directory. fh must hold the final CRC32, sizes and extra
+// fields, as Entry returns them for a finished entry.
+func (w *Writer) AppendEntry(fh *FileHeader, offset, contentOffset int64) error {
+	if err := w.CloseEntry(); err != nil {
+		return err
+	}
+	w.dir = append(w.dir, &header{FileHeader: fh, offset: uint64(offset), contentOffset: uint64(contentOffset)})
+	return nil
+}
+
+// AppendDuplicate adds an entry with the name and attributes of fh whose
+// contents are those of the i'th entry. Only a central directory record is
+// written for it, pointing at the local header and contents of the i'th
+// entry, so that identical contents are stored once. fh's method, CRC32
+// and sizes are set from the i'th entry, which is finished if it is still
+// being written. Neither entry can be a directory.
+func (w *Writer) AppendDuplicate(fh *FileHeader, i int) error {
+	if err := w.CloseEntry(); err != nil {
+		return err
+	}
+	if i < 0 || i >= len(w.dir) {
+		return errors.New("zip: AppendDuplicate of unknown entry")
+	}
+	target := w.dir[i]
+	if strings.HasSuffix(fh.Name, "/") || strings.HasSuffix(target.Name, "/") {
+		return errors.New("zip: AppendDuplicate of a directory")
+	}
+	prepareHeader(fh)
+	fh.Flags = fh.Flags&0x800 | target.Flags&^0x800 // keep the name's encoding
+	fh.ReaderVersion = target.ReaderVersion
+	fh.Method = target.Method
+	fh.CRC32 = target.CRC32
+	fh.CompressedSize = target.CompressedSize
+	fh.UncompressedSize = target.UncompressedSize
+	fh.CompressedSize64 = target.CompressedSize64
+	fh.UncompressedSize64 = target.UncompressedSize64
+	w.dir = append(w.dir, &header{
+		FileHeader:    fh,
+		offset:        target.offset,
+		contentOffset: target.contentOffset,
+		raw:           target.raw,
+	})
+	return nil
+}
+
+// DirectorySize returns the size of the central directory Close will write
+// for the entries created so far, not counting the end of central directory
+// records. The entries must be finished.
+func (w *Writer) DirectorySize() int64 {
+	var n int64
+	for _, h := range w.dir {
+		n += directoryHeaderLen + int64(len(h.Name)+len(h.Extra)+len(h.Comment))
+		// See the Zip64 extra field written by Close.
+		var zip64 int64
+		if h.UncompressedSize64 >= uint32max {
+			zip64 += 8
+		}
+		if h.CompressedSize64 >= uint32max {
+			zip64 += 8
+		}
+		if h.offset >= uint32max {
+			zip64 += 8
+		}
+		if zip64 > 0 {
+			n += 4 + zip64
+		}
+	}
+	return n
+}
+
+// SetComment sets the end-of-central-directory comment field.
+// It can only be called before Writer.Close.
+func (w *Writer) SetComment(comment string) error {
+	if len(comment) > uint16max {
+		return errors.New("zip: Writer.Comment too long")
+	}
+	w.comment = comment
+	return nil
+}
+
+// Close finishes writing the zip file by writing the central directory.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.last != nil && !w.last.closed {
+		if err := w.last.close(); err != nil {
+			return err
+		}
+		w.last = nil
+	}
+	if w.closed {
+		return errors.New("zip: writer closed twice")
+	}
+	w.closed = true
+
+	// write central directory
+	start := w.cw.count
+	usedZip64 := false
+	for _, h := range w.dir {
+		// For the Central Directory, we always have the correct sizes.
+		//
+		// Implementations disagree on what triggers the inclusion of a Zip64
+		// extra field: Info-ZIP only writes it if any size or offset EXCEEDS
+		// 4GiB - 1, while libarchive writes it if any size REACHES OR EXCEEDS
+		// 4GiB - 1, or if the offset EXCEEDS 4GiB - 1. The spec is ambiguous.
+		//
+		// We conservatively write Zip64 extra fields if any size or offset
+		// REACHES OR EXCEEDS 4GiB - 1, to maximize compatibility with readers.
+		// There is no ambiguity in parsing, so there is no downside to it.
+		//
+		// The spec is clear though that all and only the fields that REACH OR
+		// EXCEED 4GiB - 1 are included in the Zip64 extra, once it's present.
+		readerVersion := h.ReaderVersion
+		if h.CompressedSize64 >= uint32max || h.UncompressedSize64 >= uint32max || h.offset >= uint32max {
+			usedZip64 = true
+			if readerVersion < zipVersion45 {
+				readerVersion = zipVersion45
+			}
+			var size uint16
+			var buf [28]byte // 2x uint16 + up to 3x uint64
+			eb := writeBuf(buf[:])
+			eb.uint16(zip64ExtraID)
+			eb.uint16(0) // size to be filled out later
+			if h.UncompressedSize64 >= uint32max {
+				eb.uint64(h.UncompressedSize64)
+				size += 8
+			}
+			if h.CompressedSize64 >= uint32max {
+				eb.uint64(h.CompressedSize64)
+				size += 8
+			}
+			if h.offset >= uint32max {
+				eb.uint64(h.offset)
+				size += 8
+			}
+			sb := writeBuf(buf[2:])
+			sb.uint16(size)
+			h.Extra = append(h.Extra, buf[:4+size]...)
+		}
+
+		var buf [directoryHeaderLen]byte
+		b := writeBuf(buf[:])
+		b.uint32(uint32(directoryHeaderSignature))
+		b.uint16(h.CreatorVersion)
+		b.uint16(readerVersion)
+		b.uint16(h.Flags)
+		b.uint16(h.Method)
+		b.uint16(h.ModifiedTime)
+		b.uint16(h.ModifiedDate)
+		b.uint32(h.CRC32)
+		b.uint32(clampUint32(h.CompressedSize64))
+		b.uint32(clampUint32(h.UncompressedSize64))
+		b.uint16(uint16(len(h.Name)))
+		b.uint16(uint16(len(h.Extra)))
+		b.uint16(uint16(len(h.Comment)))
+		b = b[4:] // skip disk number start and internal file attr (2x uint16)
+		b.uint32(h.ExternalAttrs)
+		b.uint32(clampUint32(h.offset))
+		if _, err := w.cw.Write(buf[:]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w.cw, h.Name); err != nil {
+			return err
+		}
+		if _, err := w.cw.Write(h.Extra); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w.cw, h.Comment); err != nil {
+			return err
+		}
+	}
+	end := w.cw.count
+
+	records := uint64(len(w.dir))
+	size := uint64(end - start)
+	offset := uint64(start)
+
+	if f := w.testHookCloseSizeOffset; f != nil {
+		f(size, offset)
+	}
+
+	// Emit the Zip64 EOCD records whenever any individual entry needed a Zip64
+	// extra field, even if the EOCD's own fields fit in 32 bits, matching
+	// Info-ZIP (but not libarchive). See APPNOTE 4.3.9.2: "when Zip64
+	// extensions are in use, the EOCD64 record must be present."
+	if usedZip64 || records >= uint16max || size >= uint32max || offset >= uint32max {
+		var buf [directory64EndLen + directory64LocLen]byte
+		b := writeBuf(buf[:])
+
+		// zip64 end of central directory record
+		b.uint32(directory64EndSignature)
+		b.uint64(directory64EndLen - 12) // length minus signature (uint32) and length fields (uint64)
+		b.uint16(zipVersion45)           // version made by
+		b.uint16(zipVersion45)           // version needed to extract
+		b.uint32(0)                      // number of this disk
+		b.uint32(0)                      // number of the disk with the start of the central directory
+		b.uint64(records)                // total number of entries in the central directory on this disk
+		b.uint64(records)                // total number of entries in the central directory
+		b.uint64(size)                   // size of the central directory
+		b.uint64(offset)                 // offset of start of central directory with respect to the starting disk number
 
-var NewWriter = zip.NewWriter
+		// zip64 end of central directory locator
+		b.uint32(directory64LocSignature)
+		b.uint32(0)           // number of the disk with the start of the zip64 end of central directory
+		b.uint64(uint64(end)) // relative offset of the zip64 end of central directory record
+		b.uint32(1)           // total number of disks
+
+		if _, err := w.cw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	// write end record
+	var buf [directoryEndLen]byte
+	b := writeBuf(buf[:])
+	b.uint32(uint32(directoryEndSignature))
+	b = b[4:]                        // skip over disk number and first disk number (2x uint16)
+	b.uint16(clampUint16(records))   // number of entries this disk
+	b.uint16(clampUint16(records))   // number of entries total
+	b.uint32(clampUint32(size))      // size of directory
+	b.uint32(clampUint32(offset))    // start of directory
+	b.uint16(uint16(len(w.comment))) // byte size of EOCD comment
+	if _, err := w.cw.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w.cw, w.comment); err != nil {
+		return err
+	}
+
+	return w.cw.w.(*bufio.Writer).Flush()
+}
+
+// Create adds a file to the zip file using the provided name.
+// It returns a Writer to which the file contents should be written.
+// The file contents will be compressed using the Deflate method.
+// The name must be a relative path: it must not start with a drive
+// letter (e.g. C:) or leading slash, and only forward slashes are
+// allowed. To create a directory instead of a file, add a trailing
+// slash to the name. Duplicate names will not overwrite previous entries
+// and are appended to the zip file.
+// The file's contents must be written to the io.Writer before the next
+// call to Writer.Create, Writer.CreateHeader, or Writer.Close.
+func (w *Writer) Create(name string) (io.Writer, error) {
+	header := &FileHeader{
+		Name:   name,
+		Method: Deflate,
+	}
+	return w.CreateHeader(header)
+}
 
 // detectUTF8 reports whether s is a valid UTF-8 string, and whether the string
 // must be considered UTF-8 encoding (i.e., not compatible with CP-437, ASCII,
@@ -37,6 +378,467 @@ func detectUTF8(s string) (valid, require bool) {
 	return true, require
 }
 
+// prepare performs the bookkeeping operations required at the start of
+// CreateHeader and CreateRaw.
+func (w *Writer) prepare(fh *FileHeader) error {
+	if w.last != nil && !w.last.closed {
+		if err := w.last.close(); err != nil {
+			return err
+		}
+	}
+	if len(w.dir) > 0 && w.dir[len(w.dir)-1].FileHeader == fh {
+		// See https://golang.org/issue/11144 confusion.
+		return errors.New("archive/zip: invalid duplicate FileHeader")
+	}
+	return nil
+}
+
+// CreateHeader adds a file to the zip archive using the provided FileHeader
+// for the file metadata. Writer takes ownership of fh and may mutate
+// its fields. The caller must not modify fh after calling Writer.CreateHeader.
+//
+// This returns a Writer to which the file contents should be written.
+// The file's contents must be written to the io.Writer before the next
+// call to Writer.Create, Writer.CreateHeader, Writer.CreateRaw, or Writer.Close.
+func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
+	if err := w.prepare(fh); err != nil {
+		return nil, err
+	}
+	prepareHeader(fh)
+
+	var (
+		ow io.Writer
+		fw *fileWriter
+	)
+	h := &header{
+		FileHeader: fh,
+		offset:     uint64(w.cw.count),
+	}
+
+	if strings.HasSuffix(fh.Name, "/") {
+		// Set the compression method to Store to ensure data length is truly zero,
+		// which the writeHeader method always encodes for the size fields.
+		// This is necessary as most compression formats have non-zero lengths
+		// even when compressing an empty string.
+		fh.Method = Store
+		fh.Flags &^= 0x8 // we will not write a data descriptor
+
+		// Explicitly clear sizes as they have no meaning for directories.
+		fh.CompressedSize = 0
+		fh.CompressedSize64 = 0
+		fh.UncompressedSize = 0
+		fh.UncompressedSize64 = 0
+
+		ow = dirWriter{}
+	} else {
+		fh.Flags |= 0x8 // we will write a data descriptor
+
+		fw = &fileWriter{
+			zipw:      w.cw,
+			compCount: &countWriter{w: w.cw},
+			crc32:     crc32.NewIEEE(),
+		}
+		comp := w.compressor(fh.Method)
+		if comp == nil {
+			return nil, ErrAlgorithm
+		}
+		var err error
+		fw.comp, err = comp(fw.compCount)
+		if err != nil {
+			return nil, err
+		}
+		fw.rawCount = &countWriter{w: fw.comp}
+		fw.header = h
+		ow = fw
+	}
+	w.dir = append(w.dir, h)
+	if err := writeHeader(w.cw, h); err != nil {
+		return nil, err
+	}
+	h.contentOffset = uint64(w.cw.count)
+	// If we're creating a directory, fw is nil.
+	w.last = fw
+	return ow, nil
+}
+
+// CreateCompressed adds a file whose contents are already compressed with
+// fh.Method, and whose CRC32 and sizes are already set in fh. Unlike
+// CreateRaw, the entry is encoded exactly as CreateHeader would encode it,
+// including the extended timestamp and the data descriptor, so contents
+// compressed ahead of time produce the same archive as compressing them
+// while writing. fh must not name a directory.
+//
+// This returns a Writer to which the compressed contents should be written.
+func (w *Writer) CreateCompressed(fh *FileHeader) (io.Writer, error) {
+	if strings.HasSuffix(fh.Name, "/") {
+		return nil, errors.New("zip: CreateCompressed of a directory")
+	}
+	if err := w.prepare(fh); err != nil {
+		return nil, err
+	}
+	prepareHeader(fh)
+
+	fh.Flags |= 0x8 // we will write a data descriptor
+	if fh.CompressedSize64 > uint32max || fh.UncompressedSize64 > uint32max {
+		fh.CompressedSize = uint32max
+		fh.UncompressedSize = uint32max
+		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+	} else {
+		fh.CompressedSize = uint32(fh.CompressedSize64)
+		fh.UncompressedSize = uint32(fh.UncompressedSize64)
+	}
+
+	h := &header{
+		FileHeader: fh,
+		offset:     uint64(w.cw.count),
+		raw:        true,
+	}
+	w.dir = append(w.dir, h)
+	if err := writeHeader(w.cw, h); err != nil {
+		return nil, err
+	}
+	h.contentOffset = uint64(w.cw.count)
+	fw := &fileWriter{
+		header: h,
+		zipw:   w.cw,
+	}
+	w.last = fw
+	return fw, nil
+}
+
+// SetHeaderName sets the name of fh, and sets or clears the UTF-8 flag for
+// the new name as CreateHeader would. CreateRaw writes headers as they
+// are, so it is needed when renaming an entry copied from another archive.
+func SetHeaderName(fh *FileHeader, name string) {
+	fh.Name = name
+	fh.NonUTF8 = false
+	fh.Flags &^= 0x800
+	setUTF8Flag(fh)
+}
+
+// setUTF8Flag sets the UTF-8 flag of fh if its name or comment need it;
+// see prepareHeader.
+func setUTF8Flag(fh *FileHeader) {
+	utf8Valid1, utf8Require1 := detectUTF8(fh.Name)
+	utf8Valid2, utf8Require2 := detectUTF8(fh.Comment)
+	switch {
+	case fh.NonUTF8:
+		fh.Flags &^= 0x800
+	case (utf8Require1 || utf8Require2) && (utf8Valid1 && utf8Valid2):
+		fh.Flags |= 0x800
+	}
+}
+
+// prepareHeader sets the flags, versions and timestamps of fh for
+// CreateHeader and CreateCompressed.
+func prepareHeader(fh *FileHeader) {
+	// The ZIP format has a sad state of affairs regarding character encoding.
+	// Officially, the name and comment fields are supposed to be encoded
+	// in CP-437 (which is mostly compatible with ASCII), unless the UTF-8
+	// flag bit is set. However, there are several problems:
+	//
+	//	* Many ZIP readers still do not support UTF-8.
+	//	* If the UTF-8 flag is cleared, several readers simply interpret the
+	//	name and comment fields as whatever the local system encoding is.
+	//
+	// In order to avoid breaking readers without UTF-8 support,
+	// we avoid setting the UTF-8 flag if the strings are CP-437 compatible.
+	// However, if the strings require multibyte UTF-8 encoding and is a
+	// valid UTF-8 string, then we set the UTF-8 bit.
+	//
+	// For the case, where the user explicitly wants to specify the encoding
+	// as UTF-8, they will need to set the flag bit themselves.
+	setUTF8Flag(fh)
+
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20 // preserve compatibility byte
+	fh.ReaderVersion = zipVersion20
+
+	// If Modified is set, this takes precedence over MS-DOS timestamp fields.
+	// Unlike archive/zip, an extended timestamp already present in Extra,
+	// such as one made by ExtendedTimeExtra, is kept instead of adding another.
+	if !fh.Modified.IsZero() {
+		// Contrary to the FileHeader.SetModTime method, we intentionally
+		// do not convert to UTC, because we assume the user intends to encode
+		// the date using the specified timezone. A user may want this control
+		// because many legacy ZIP readers interpret the timestamp according
+		// to the local timezone.
+		//
+		// The timezone is only non-UTC if a user directly sets the Modified
+		// field directly themselves. All other approaches sets UTC.
+		fh.ModifiedDate, fh.ModifiedTime = timeToMsDosTime(fh.Modified)
+
+		// Use "extended timestamp" format since this is what Info-ZIP uses.
+		// Nearly every major ZIP implementation uses a different format,
+		// but at least most seem to be able to understand the other formats.
+		//
+		// This format happens to be identical for both local and central header
+		// if modification time is the only timestamp being encoded.
+		if !hasExtraField(fh.Extra, extTimeExtraID) {
+			var mbuf [9]byte // 2*SizeOf(uint16) + SizeOf(uint8) + SizeOf(uint32)
+			mt := uint32(fh.Modified.Unix())
+			eb := writeBuf(mbuf[:])
+			eb.uint16(extTimeExtraID)
+			eb.uint16(5)  // Size: SizeOf(uint8) + SizeOf(uint32)
+			eb.uint8(1)   // Flags: ModTime
+			eb.uint32(mt) // ModTime
+			fh.Extra = append(fh.Extra, mbuf[:]...)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, h *header) error {
+	const maxUint16 = 1<<16 - 1
+	if len(h.Name) > maxUint16 {
+		return errLongName
+	}
+	if len(h.Extra) > maxUint16 {
+		return errLongExtra
+	}
+
+	// The correct behavior of a streaming writer, implemented by Info-ZIP 3.0,
+	// would be to write 0xFFFFFFFF in the size fields and then write a Zip64
+	// extra field with the sizes at zero (to signal they are stored in a ZIP64
+	// data descriptor, in case the file is > 4GiB).
+	//
+	// We don't do that, and instead write zeroes directly in the size fields,
+	// because that wastes 28 bytes for every file smaller than 4GiB, and
+	// because it would change the encoding of nearly every zip file created by
+	// archive/zip. (No one should rely on it being stable, but still.)
+	//
+	// Anyway, the Local File Header is not that important, as the Central
+	// Directory is authoritative, and there we always write the correct sizes.
+	//
+	// If we do know the sizes, because Writer.CreateRaw is used and the data
+	// descriptor flag is not set, then we write them to the header. If either
+	// size reaches 4GiB, we write 0xFFFFFFFF placeholders and a Zip64 extra
+	// field with BOTH sizes, per the spec and matching Info-ZIP. Note this is
+	// different from the Central Directory Zip64 extra field logic, somehow.
+	//
+	// (One final interesting case that doesn't apply to us: if the input is
+	// streaming but the output is seekable, Info-ZIP always writes Zip64 extra
+	// fields, and then goes back and patches in the sizes, even for files < 4GiB.)
+
+	var zip64ExtraInfo []byte
+	readerVersion := h.ReaderVersion
+	noDataDescriptor := h.raw && !hasDataDescriptor(h.FileHeader)
+	if noDataDescriptor && (h.CompressedSize64 > uint32max || h.UncompressedSize64 > uint32max) {
+		if readerVersion < zipVersion45 {
+			readerVersion = zipVersion45
+		}
+		zip64ExtraInfo = make([]byte, 20) // 2x uint16 + 2x uint64
+		b := writeBuf(zip64ExtraInfo)
+		b.uint16(zip64ExtraID)
+		b.uint16(16) // size of Zip64 extra field data
+		b.uint64(h.UncompressedSize64)
+		b.uint64(h.CompressedSize64)
+	}
+
+	var buf [fileHeaderLen]byte
+	b := writeBuf(buf[:])
+	b.uint32(uint32(fileHeaderSignature))
+	b.uint16(readerVersion)
+	b.uint16(h.Flags)
+	b.uint16(h.Method)
+	b.uint16(h.ModifiedTime)
+	b.uint16(h.ModifiedDate)
+	if noDataDescriptor {
+		b.uint32(h.CRC32)
+		if zip64ExtraInfo != nil {
+			b.uint32(uint32max)
+			b.uint32(uint32max)
+		} else {
+			b.uint32(uint32(h.CompressedSize64))
+			b.uint32(uint32(h.UncompressedSize64))
+		}
+	} else {
+		b.uint32(0) // crc32
+		b.uint32(0) // compressed size
+		b.uint32(0) // uncompressed size
+	}
+	b.uint16(uint16(len(h.Name)))
+	b.uint16(uint16(len(h.Extra) + len(zip64ExtraInfo)))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, h.Name); err != nil {
+		return err
+	}
+	if _, err := w.Write(h.Extra); err != nil {
+		return err
+	}
+	if _, err := w.Write(zip64ExtraInfo); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CreateRaw adds a file to the zip archive using the provided FileHeader and
+// returns a Writer to which the file contents should be written. The file's
+// contents must be written to the io.Writer before the next call to Writer.Create,
+// Writer.CreateHeader, Writer.CreateRaw, or Writer.Close.
+//
+// In contrast to Writer.CreateHeader, the bytes passed to Writer are not compressed.
+//
+// CreateRaw's argument is stored in w. If the argument is a pointer to the embedded
+// FileHeader in a File obtained from a Reader created from in-memory data,
+// then w will refer to all of that memory.
+func (w *Writer) CreateRaw(fh *FileHeader) (io.Writer, error) {
+	if err := w.prepare(fh); err != nil {
+		return nil, err
+	}
+
+	fh.CompressedSize = clampUint32(fh.CompressedSize64)
+	fh.UncompressedSize = clampUint32(fh.UncompressedSize64)
+
+	h := &header{
+		FileHeader: fh,
+		offset:     uint64(w.cw.count),
+		raw:        true,
+	}
+	w.dir = append(w.dir, h)
+	if err := writeHeader(w.cw, h); err != nil {
+		return nil, err
+	}
+	h.contentOffset = uint64(w.cw.count)
+
+	if strings.HasSuffix(fh.Name, "/") {
+		w.last = nil
+		return dirWriter{}, nil
+	}
+
+	fw := &fileWriter{
+		header: h,
+		zipw:   w.cw,
+	}
+	w.last = fw
+	return fw, nil
+}
+
+// RegisterCompressor registers or overrides a custom compressor for a specific
+// method ID. If a compressor for a given method is not found, Writer will
+// default to looking up the compressor at the package level.
+func (w *Writer) RegisterCompressor(method uint16, comp Compressor) {
+	if w.compressors == nil {
+		w.compressors = make(map[uint16]Compressor)
+	}
+	w.compressors[method] = comp
+}
+
+// Compressor returns the compressor Writer uses for method, or nil if
+// there is none. It allows compressing entries ahead of time for
+// CreateRaw.
+func (w *Writer) Compressor(method uint16) Compressor {
+	return w.compressor(method)
+}
+
+func (w *Writer) compressor(method uint16) Compressor {
+	comp := w.compressors[method]
+	if comp == nil {
+		comp = compressor(method)
+	}
+	return comp
+}
+
+type dirWriter struct{}
+
+func (dirWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return 0, errors.New("zip: write to directory")
+}
+
+type fileWriter struct {
+	*header
+	zipw      io.Writer
+	rawCount  *countWriter
+	comp      io.WriteCloser
+	compCount *countWriter
+	crc32     hash.Hash32
+	closed    bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("zip: write to closed file")
+	}
+	if w.raw {
+		return w.zipw.Write(p)
+	}
+	w.crc32.Write(p)
+	return w.rawCount.Write(p)
+}
+
+func (w *fileWriter) close() error {
+	if w.closed {
+		return errors.New("zip: file closed twice")
+	}
+	w.closed = true
+	if w.raw {
+		return w.writeDataDescriptor()
+	}
+	if err := w.comp.Close(); err != nil {
+		return err
+	}
+
+	// update FileHeader
+	fh := w.header.FileHeader
+	fh.CRC32 = w.crc32.Sum32()
+	fh.CompressedSize64 = uint64(w.compCount.count)
+	fh.UncompressedSize64 = uint64(w.rawCount.count)
+
+	if w.CompressedSize64 > uint32max || w.UncompressedSize64 > uint32max {
+		fh.CompressedSize = uint32max
+		fh.UncompressedSize = uint32max
+		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+	} else {
+		fh.CompressedSize = uint32(fh.CompressedSize64)
+		fh.UncompressedSize = uint32(fh.UncompressedSize64)
+	}
+
+	return w.writeDataDescriptor()
+}
+
+func (w *fileWriter) writeDataDescriptor() error {
+	if !hasDataDescriptor(w.FileHeader) {
+		return nil
+	}
+	// See the comment in writeHeader about how and why we don't signal ZIP64
+	// mode in the local file header. If one of the sizes turns out to exceed
+	// 4GiB, we use the 64-bit sizes anyway, for lack of alternatives.
+	//
+	// See also https://bugs.openjdk.org/browse/JDK-7073588.
+	var buf []byte
+	if w.CompressedSize64 > uint32max || w.UncompressedSize64 > uint32max {
+		buf = make([]byte, dataDescriptor64Len)
+	} else {
+		buf = make([]byte, dataDescriptorLen)
+	}
+	b := writeBuf(buf)
+	b.uint32(dataDescriptorSignature) // de-facto standard, required by OS X
+	b.uint32(w.CRC32)
+	if w.CompressedSize64 > uint32max || w.UncompressedSize64 > uint32max {
+		b.uint64(w.CompressedSize64)
+		b.uint64(w.UncompressedSize64)
+	} else {
+		b.uint32(w.CompressedSize)
+		b.uint32(w.UncompressedSize)
+	}
+	_, err := w.zipw.Write(buf)
+	return err
+}
+
+type countWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
 type nopCloser struct {
 	io.Writer
 }
@@ -44,3 +846,115 @@ type nopCloser struct {
 func (w nopCloser) Close() error {
 	return nil
 }
+
+type writeBuf []byte
+
+func (b *writeBuf) uint8(v uint8) {
+	(*b)[0] = v
+	*b = (*b)[1:]
+}
+
+func (b *writeBuf) uint16(v uint16) {
+	binary.LittleEndian.PutUint16(*b, v)
+	*b = (*b)[2:]
+}
+
+func (b *writeBuf) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(*b, v)
+	*b = (*b)[4:]
+}
+
+func (b *writeBuf) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(*b, v)
+	*b = (*b)[8:]
+}
+
+// ExtendedTimeExtra returns an extended timestamp extra field holding
+// the given times, for use in FileHeader.Extra. Zero times are left out.
+func ExtendedTimeExtra(modified, accessed, created time.Time) []byte {
+	buf := make([]byte, 5, 17)
+	var flags uint8
+	for i, t := range []time.Time{modified, accessed, created} {
+		if t.IsZero() {
+			continue
+		}
+		flags |= 1 << i
+		buf = buf[:len(buf)+4]
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(t.Unix()))
+	}
+	b := writeBuf(buf)
+	b.uint16(extTimeExtraID)
+	b.uint16(uint16(len(buf) - 4))
+	b.uint8(flags)
+	return buf
+}
+
+// UnixOwnerExtra returns an Info-ZIP Unix extra field recording the
+// owner of a file, for use in FileHeader.Extra.
+func UnixOwnerExtra(uid, gid int) []byte {
+	var buf [15]byte // 2x uint16 + version + 2x (size + uint32)
+	b := writeBuf(buf[:])
+	b.uint16(unixOwnerExtraID)
+	b.uint16(11)
+	b.uint8(1) // version
+	b.uint8(4)
+	b.uint32(uint32(uid))
+	b.uint8(4)
+	b.uint32(uint32(gid))
+	return buf[:]
+}
+
+// StripAttributeExtras returns a copy of extra without the fields that
+// record timestamps and owners, keeping any others, such as the digest.
+func StripAttributeExtras(extra []byte) []byte {
+	var kept []byte
+	for b := readBuf(extra); len(b) >= 4; {
+		field := []byte(b)
+		fieldTag := b.uint16()
+		fieldSize := int(b.uint16())
+		if len(b) < fieldSize {
+			break
+		}
+		b.sub(fieldSize)
+		switch fieldTag {
+		case ntfsExtraID, unixExtraID, extTimeExtraID, infoZipUnixExtraID, unixOwnerExtraID:
+			continue
+		}
+		kept = append(kept, field[:4+fieldSize]...)
+	}
+	return kept
+}
+
+// hasExtraField reports whether extra contains a field with the given id.
+func hasExtraField(extra []byte, id uint16) bool {
+	for b := readBuf(extra); len(b) >= 4; {
+		fieldTag := b.uint16()
+		fieldSize := int(b.uint16())
+		if len(b) < fieldSize {
+			return false
+		}
+		if fieldTag == id {
+			return true
+		}
+		b.sub(fieldSize)
+	}
+	return false
+}
+
+func hasDataDescriptor(h *FileHeader) bool {
+	return h.Flags&0x8 != 0
+}
+
+func clampUint16(v uint64) uint16 {
+	if v > uint16max {
+		return uint16max
+	}
+	return uint16(v)
+}
+
+func clampUint32(v uint64) uint32 {
+	if v > uint32max {
+		return uint32max
+	}
+	return uint32(v)
+}
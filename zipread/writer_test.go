@@ -371,3 +371,400 @@ func BenchmarkCompressedZipGarbage(b *testing.B) {
 		}
 	})
 }
+
+func TestWriterCloseEntry(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{Name: "foo", Method: Deflate}
+	fw, err := w.CreateHeader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("hello, world! "), 100)
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseEntry(); err != nil {
+		t.Fatal(err)
+	}
+	if fh.UncompressedSize64 != uint64(len(content)) {
+		t.Errorf("UncompressedSize64=%d, want %d", fh.UncompressedSize64, len(content))
+	}
+	if fh.CompressedSize64 == 0 || fh.CompressedSize64 >= fh.UncompressedSize64 {
+		t.Errorf("unexpected CompressedSize64=%d", fh.CompressedSize64)
+	}
+	if _, err := fw.Write(content); err == nil {
+		t.Error("expected error writing to closed entry")
+	}
+	if err := w.CloseEntry(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 1 || r.File[0].CRC32 != fh.CRC32 {
+		t.Fatalf("unexpected archive contents: %+v", r.File)
+	}
+}
+
+func TestNewEntryReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	content := bytes.Repeat([]byte("entry reader "), 100)
+	fh := &FileHeader{Name: "foo", Method: Deflate}
+	fw, err := w.CreateHeader(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The deflated content starts right after the local header.
+	start := fileHeaderLen + len(fh.Name) + len(fh.Extra)
+	raw := buf.Bytes()[start : start+int(fh.CompressedSize64)]
+
+	rc, err := NewEntryReader(io.NopCloser(bytes.NewReader(raw)), fh.Method, fh.CRC32, fh.UncompressedSize64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("wrong content")
+	}
+
+	rc, err = NewEntryReader(io.NopCloser(bytes.NewReader(raw)), fh.Method, fh.CRC32+1, fh.UncompressedSize64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rc); err != ErrChecksum {
+		t.Fatalf("got %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestWriterAttributeExtras(t *testing.T) {
+	modified := time.Date(2021, 3, 4, 5, 6, 8, 0, time.UTC)
+	accessed := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	created := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fh := &FileHeader{Name: "foo", Method: Store, Modified: modified}
+	fh.Extra = append(fh.Extra, ExtendedTimeExtra(modified, accessed, created)...)
+	fh.Extra = append(fh.Extra, UnixOwnerExtra(1000, 1001)...)
+	if _, err := w.CreateHeader(fh); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+	if got := bytes.Count(f.Extra, []byte{0x55, 0x54}); got != 1 {
+		t.Errorf("found %d extended timestamp fields, want 1", got)
+	}
+	if !f.Modified.Equal(modified) {
+		t.Errorf("Modified=%v, want %v", f.Modified, modified)
+	}
+	if !f.AccessTime.Equal(accessed) {
+		t.Errorf("AccessTime=%v, want %v", f.AccessTime, accessed)
+	}
+	if !f.CreationTime.Equal(created) {
+		t.Errorf("CreationTime=%v, want %v", f.CreationTime, created)
+	}
+	if f.UID != 1000 || f.GID != 1001 {
+		t.Errorf("UID, GID=%d, %d, want 1000, 1001", f.UID, f.GID)
+	}
+}
+
+func TestDeflateCompressorLevels(t *testing.T) {
+	if _, err := DeflateCompressor(10); err == nil {
+		t.Fatal("expected error for invalid level")
+	}
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 1000)
+	sizes := make(map[int]uint64)
+	for _, level := range []int{1, 9} {
+		comp, err := DeflateCompressor(level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write twice so the second entry reuses a pooled writer.
+		for i := 0; i < 2; i++ {
+			buf := new(bytes.Buffer)
+			w := NewWriter(buf)
+			w.RegisterCompressor(Deflate, comp)
+			fw, err := w.CreateHeader(&FileHeader{Name: "data.txt", Method: Deflate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := r.File[0]
+			if i > 0 && f.CompressedSize64 != sizes[level] {
+				t.Errorf("level %d: pooled writer gave size %d, want %d", level, f.CompressedSize64, sizes[level])
+			}
+			sizes[level] = f.CompressedSize64
+			testReadFile(t, f, &WriteTest{Name: "data.txt", Data: data, Method: Deflate, Mode: 0666})
+		}
+	}
+	if sizes[9] > sizes[1] {
+		t.Errorf("level 9 size %d is larger than level 1 size %d", sizes[9], sizes[1])
+	}
+}
+
+func TestFileOpenRawCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("raw copy "), 1000)
+	src := new(bytes.Buffer)
+	w := NewWriter(src)
+	fw, err := w.CreateHeader(&FileHeader{Name: "data.txt", Method: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(src.Bytes()), int64(src.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+
+	rc, err := f.OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(raw)) != f.CompressedSize64 {
+		t.Fatalf("raw length=%d, want %d", len(raw), f.CompressedSize64)
+	}
+
+	dst := new(bytes.Buffer)
+	w = NewWriter(dst)
+	header := f.FileHeader
+	rw, err := w.CreateRaw(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rw.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Open(SourceFromReaderAt(bytes.NewReader(dst.Bytes()), int64(dst.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReadFile(t, r.File[0], &WriteTest{Name: "data.txt", Data: data, Method: Deflate, Mode: 0666})
+}
+
+func TestWriterAppendEntry(t *testing.T) {
+	// Write the first part of an archive, then continue it with a new
+	// Writer that only knows the entries written so far.
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	fw, err := w.CreateHeader(&FileHeader{Name: "first.txt", Method: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(fw, "first entry"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseEntry(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.NumEntries() != 1 {
+		t.Fatalf("NumEntries=%d, want 1", w.NumEntries())
+	}
+	fh, offset := w.Entry(0)
+	if offset != 0 {
+		t.Fatalf("offset=%d, want 0", offset)
+	}
+	contentOffset := w.ContentOffset(0)
+	if want := int64(fileHeaderLen + len("first.txt")); contentOffset != want {
+		t.Fatalf("content offset=%d, want %d", contentOffset, want)
+	}
+	saved := *fh
+
+	w2 := NewWriter(buf)
+	w2.SetOffset(int64(buf.Len()))
+	if err := w2.AppendEntry(&saved, offset, contentOffset); err != nil {
+		t.Fatal(err)
+	}
+	if w2.ContentOffset(0) != contentOffset {
+		t.Fatalf("appended content offset=%d, want %d", w2.ContentOffset(0), contentOffset)
+	}
+	fw, err = w2.CreateHeader(&FileHeader{Name: "second.txt", Method: Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(fw, "second entry"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("got %d files, want 2", len(r.File))
+	}
+	testReadFile(t, r.File[0], &WriteTest{Name: "first.txt", Data: []byte("first entry"), Method: Deflate, Mode: 0666})
+	testReadFile(t, r.File[1], &WriteTest{Name: "second.txt", Data: []byte("second entry"), Method: Store, Mode: 0666})
+}
+
+func TestWriterAppendDuplicate(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	data := bytes.Repeat([]byte("shared content "), 100)
+	fw, err := w.CreateHeader(&FileHeader{Name: "original.txt", Method: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendDuplicate(&FileHeader{Name: "a/much/longer/name/for/the/copy.txt"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendDuplicate(&FileHeader{Name: "dir/"}, 0); err == nil {
+		t.Fatal("AppendDuplicate of a directory succeeded")
+	}
+	if w.ContentOffset(1) != w.ContentOffset(0) {
+		t.Fatalf("content offsets %d and %d differ", w.ContentOffset(0), w.ContentOffset(1))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("got %d files, want 2", len(r.File))
+	}
+	testReadFile(t, r.File[0], &WriteTest{Name: "original.txt", Data: data, Method: Deflate, Mode: 0666})
+	testReadFile(t, r.File[1], &WriteTest{Name: "a/much/longer/name/for/the/copy.txt", Data: data, Method: Deflate, Mode: 0666})
+	got, err := fs.ReadFile(r, "a/much/longer/name/for/the/copy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("wrong content through fs.ReadFile")
+	}
+}
+
+func TestWriterDirectorySize(t *testing.T) {
+	w := NewWriter(io.Discard)
+	for i, name := range []string{"a.txt", "dir/", "ünïcode.txt"} {
+		fw, err := w.CreateHeader(&FileHeader{Name: name, Comment: name, Modified: time.Unix(int64(i), 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "dir/" {
+			if _, err := io.WriteString(fw, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A fake entry large enough to need a Zip64 extra field.
+	if err := w.AppendEntry(&FileHeader{Name: "big", UncompressedSize64: 1 << 33, CompressedSize64: 1 << 33}, 0, 30); err != nil {
+		t.Fatal(err)
+	}
+	want := w.DirectorySize()
+	var got uint64
+	w.testHookCloseSizeOffset = func(size, offset uint64) { got = size }
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if int64(got) != want {
+		t.Fatalf("DirectorySize=%d, Close wrote %d", want, got)
+	}
+}
+
+func TestReaderLocalNameLength(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, name := range []string{"a.txt", "bb.txt", "ccc.txt"} {
+		fw, err := w.CreateHeader(&FileHeader{Name: name, Method: Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fw, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the local header offsets of the last two entries, so that their
+	// local names no longer match without any header being shared.
+	data := buf.Bytes()
+	var offsets []int
+	for i := 0; i+4 <= len(data); i++ {
+		if binary.LittleEndian.Uint32(data[i:]) == directoryHeaderSignature {
+			offsets = append(offsets, i+42)
+		}
+	}
+	if len(offsets) != 3 {
+		t.Fatalf("found %d central directory records, want 3", len(offsets))
+	}
+	b, c := data[offsets[1]:offsets[1]+4], data[offsets[2]:offsets[2]+4]
+	var tmp [4]byte
+	copy(tmp[:], b)
+	copy(b, c)
+	copy(c, tmp[:])
+
+	r, err := Open(SourceFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.File[0].Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File[1:] {
+		if _, err := f.Open(); err != ErrFormat {
+			t.Errorf("%s: got %v, want ErrFormat", f.Name, err)
+		}
+	}
+}